@@ -0,0 +1,331 @@
+package monerotipbot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omani/go-monero-rpc-client/wallet"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// auditAdmin records an action of the current admin
+func (mtb *MoneroTipBot) auditAdmin(action string) {
+	mtb.logger().WithFields(logrus.Fields{"admin": mtb.getUsername(), "action": action}).Info("Admin action")
+	mtb.metricIncr("admin_actions.counter", 1)
+
+	entry := mtb.newAuditEntry("admin")
+	entry.Details = action
+	mtb.audit(entry)
+}
+
+// findAccount looks up a wallet account by telegram user id, @username or #accountindex
+func (mtb *MoneroTipBot) findAccount(query string) (*Account, error) {
+	accounts, err := mtb.walletrpc.GetAccounts(&wallet.RequestGetAccounts{})
+	if err != nil {
+		return nil, err
+	}
+
+	var found *Account
+	for _, address := range accounts.SubaddressAccounts {
+		account := &Account{
+			AccountIndex:    address.AccountIndex,
+			Balance:         address.Balance,
+			BaseAddress:     address.BaseAddress,
+			Label:           address.Label,
+			Tag:             address.Tag,
+			UnlockedBalance: address.UnlockedBalance,
+		}
+
+		if strings.HasPrefix(query, "#") {
+			if fmt.Sprintf("#%d", address.AccountIndex) == query {
+				return account, nil
+			}
+			continue
+		}
+
+		split := strings.Split(address.Label, "@")
+		if len(split) != 2 {
+			continue
+		}
+		if strings.HasPrefix(query, "@") {
+			if strings.ToLower(split[0]) != strings.ToLower(strings.TrimPrefix(query, "@")) {
+				continue
+			}
+			// prefer the account with a known user id over username@0
+			if found == nil || split[1] != "0" {
+				found = account
+			}
+			continue
+		}
+		if split[1] == query {
+			return account, nil
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("No account found for %s.", query)
+	}
+	return found, nil
+}
+
+// accountUserID returns the telegram user id in the label of account. 0 for unclaimed or invalid labels.
+func accountUserID(account *Account) int64 {
+	split := strings.Split(account.Label, "@")
+	if len(split) != 2 {
+		return 0
+	}
+	userid, _ := strconv.ParseInt(split[1], 10, 64)
+	return userid
+}
+
+func (mtb *MoneroTipBot) adminStats() (string, error) {
+	accounts, err := mtb.walletrpc.GetAccounts(&wallet.RequestGetAccounts{})
+	if err != nil {
+		return "", err
+	}
+
+	var users, unclaimed int
+	for _, address := range accounts.SubaddressAccounts {
+		if !isUserAccountLabel(address.Label) {
+			continue
+		}
+		if strings.HasSuffix(address.Label, "@0") {
+			unclaimed++
+			continue
+		}
+		users++
+	}
+
+	approvalsmutex.Lock()
+	pending := len(mtb.approvals)
+	approvalsmutex.Unlock()
+
+	return fmt.Sprintf("Users: %d\nUnclaimed accounts (username@0): %d\nTotal balance: %f XMR\nUnlocked balance: %f XMR\nPooled balances: %f XMR\nOpen giveaways: %d\nPending approvals: %d\nFrozen accounts: %d\nMaintenance: %t", users, unclaimed, wallet.XMRToFloat64(accounts.TotalBalance), wallet.XMRToFloat64(accounts.TotalUnlockedBalance), wallet.XMRToFloat64(mtb.totalColdBalance()), len(mtb.giveaways), pending, mtb.frozenAccountCount(), mtb.isMaintenance()), nil
+}
+
+func (mtb *MoneroTipBot) adminUser(account *Account) string {
+	userid := accountUserID(account)
+
+	frozen := "no"
+	if f := mtb.frozenAccount(account.AccountIndex); f != nil {
+		frozen = fmt.Sprintf("yes, since %s (%s)", f.Since.Format(time.RFC1123), f.Reason)
+	}
+
+	whitelist := "off"
+	whitelistmutex.Lock()
+	if w, ok := mtb.whitelists[userid]; ok && w.Enabled {
+		whitelist = fmt.Sprintf("on (%d addresses, %d pending changes)", len(w.Addresses), len(w.Pending))
+	}
+	whitelistmutex.Unlock()
+
+	secondfactor := "none"
+	if s, ok := mtb.secondfactors[userid]; ok && len(s.Method) > 0 {
+		secondfactor = s.Method
+	}
+
+	var spent uint64
+	if l, ok := mtb.limits[userid]; ok {
+		spent = l.spentOn(time.Now().UTC())
+	}
+
+	pending := "none"
+	approvalsmutex.Lock()
+	for _, approval := range mtb.approvals {
+		if approval.AccountIndex == account.AccountIndex {
+			pending = fmt.Sprintf("#%d (%s)", approval.ID, approval.Kind)
+		}
+	}
+	approvalsmutex.Unlock()
+
+	return fmt.Sprintf("Account #%d: %s\n\nUser ID: %d\nBalance: %f XMR\nUnlocked balance: %f XMR\nPooled balance: %f XMR\nFrozen: %s\nWhitelist: %s\nSecond factor: %s\nSpent today: %f XMR\nPending approval: %s\nAddress: %s", account.AccountIndex, account.Label, userid, wallet.XMRToFloat64(account.Balance), wallet.XMRToFloat64(account.UnlockedBalance), wallet.XMRToFloat64(mtb.coldBalance(account.AccountIndex)), frozen, whitelist, secondfactor, wallet.XMRToFloat64(spent), pending, account.BaseAddress)
+}
+
+// broadcast sends text to every user with a known user id, paced by BROADCAST_NOTIFICATION_INTERVAL like the notifier
+func (mtb *MoneroTipBot) broadcast(text string, reportchat int64) {
+	accounts, err := mtb.jobWallet("broadcast").GetAccounts(&wallet.RequestGetAccounts{})
+	if err != nil {
+		jobLogger("broadcast").WithError(err).Error("Error while broadcasting")
+		return
+	}
+
+	var success, failed int
+	count := viper.GetInt("BROADCAST_NOTIFICATION_INTERVAL")
+	for _, address := range accounts.SubaddressAccounts {
+		userid := accountUserID(&Account{Label: address.Label})
+		if userid == 0 {
+			continue
+		}
+
+		err := mtb.replyWait(&Message{
+			ChatID: userid,
+			Text:   text,
+			log:    jobLogger("broadcast"),
+		})
+		if err != nil {
+			failed++
+		} else {
+			success++
+		}
+
+		count--
+		if count == 0 {
+			time.Sleep(time.Second * 5)
+			count = viper.GetInt("BROADCAST_NOTIFICATION_INTERVAL")
+		}
+	}
+
+	jobLogger("broadcast").WithFields(logrus.Fields{"sent": success, "failed": failed}).Info("Broadcast finished")
+	mtb.reply(&Message{
+		Format: true,
+		ChatID: reportchat,
+		Text:   fmt.Sprintf("Broadcast finished.\n\nSent: %d\nErrors: %d", success, failed),
+		log:    jobLogger("broadcast"),
+	})
+}
+
+func (mtb *MoneroTipBot) parseCommandADMIN() error {
+	msg := mtb.newReplyMessage(true)
+	msg.ChatID = mtb.message.Chat.ID
+
+	if !mtb.isAdmin() {
+		msg.Text = "This command is only available to admins."
+		return mtb.reply(msg)
+	}
+	// don't leak user data into public groups
+	if !mtb.message.Chat.IsPrivate() && mtb.message.Chat.ID != viper.GetInt64("ADMIN_CHAT_ID") {
+		msg.Text = "Admin commands are only available in the bot PM or the admin chat."
+		return mtb.reply(msg)
+	}
+
+	split := strings.SplitN(strings.TrimSpace(mtb.message.CommandArguments()), " ", 2)
+	var arg string
+	if len(split) > 1 {
+		arg = strings.TrimSpace(split[1])
+	}
+
+	switch split[0] {
+	case "stats":
+		stats, err := mtb.adminStats()
+		if err != nil {
+			msg.Text = fmt.Sprintf("Error while retrieving accounts: %s", err)
+			return mtb.reply(msg)
+		}
+		mtb.auditAdmin("stats")
+		msg.Text = stats
+	case "user":
+		if len(arg) == 0 {
+			msg.Text = "Please specify a user id, @username or #accountindex: /admin user @username"
+			return mtb.reply(msg)
+		}
+		account, err := mtb.findAccount(arg)
+		if err != nil {
+			msg.Text = err.Error()
+			return mtb.reply(msg)
+		}
+		mtb.auditAdmin(fmt.Sprintf("user %s", arg))
+		msg.Text = mtb.adminUser(account)
+	case "freeze":
+		split = strings.SplitN(arg, " ", 2)
+		if len(split[0]) == 0 {
+			msg.Text = "Please specify a user id, @username or #accountindex (with optional reason): /admin freeze @username your reason goes here"
+			return mtb.reply(msg)
+		}
+		account, err := mtb.findAccount(split[0])
+		if err != nil {
+			msg.Text = err.Error()
+			return mtb.reply(msg)
+		}
+		reason := "No reason given."
+		if len(split) > 1 {
+			reason = strings.TrimSpace(split[1])
+		}
+		err = mtb.freezeAccount(&FrozenAccount{
+			AccountIndex: account.AccountIndex,
+			Label:        account.Label,
+			Reason:       reason,
+			By:           int64(mtb.from.ID),
+			Since:        time.Now(),
+		})
+		if err != nil {
+			msg.Text = fmt.Sprintf("Error while freezing account: %s", err)
+			return mtb.reply(msg)
+		}
+		mtb.auditAdmin(fmt.Sprintf("freeze account #%d (%s): %s", account.AccountIndex, account.Label, reason))
+		msg.Text = fmt.Sprintf("Account #%d (%s) frozen.", account.AccountIndex, account.Label)
+	case "unfreeze":
+		if len(arg) == 0 {
+			msg.Text = "Please specify a user id, @username or #accountindex: /admin unfreeze @username"
+			return mtb.reply(msg)
+		}
+		account, err := mtb.findAccount(arg)
+		if err != nil {
+			msg.Text = err.Error()
+			return mtb.reply(msg)
+		}
+		if mtb.frozenAccount(account.AccountIndex) == nil {
+			msg.Text = fmt.Sprintf("Account #%d (%s) is not frozen.", account.AccountIndex, account.Label)
+			return mtb.reply(msg)
+		}
+		err = mtb.unfreezeAccount(account.AccountIndex)
+		if err != nil {
+			msg.Text = fmt.Sprintf("Error while unfreezing account: %s", err)
+			return mtb.reply(msg)
+		}
+		mtb.auditAdmin(fmt.Sprintf("unfreeze account #%d (%s)", account.AccountIndex, account.Label))
+		msg.Text = fmt.Sprintf("Account #%d (%s) unfrozen.", account.AccountIndex, account.Label)
+	case "broadcast":
+		if len(arg) == 0 {
+			msg.Text = "Please specify the message to broadcast: /admin broadcast your message goes here"
+			return mtb.reply(msg)
+		}
+		mtb.auditAdmin(fmt.Sprintf("broadcast %q", arg))
+		go mtb.broadcast(arg, msg.ChatID)
+		msg.Text = "Broadcast started. You will be notified when it is finished."
+	case "maintenance":
+		var err error
+		switch arg {
+		case "on":
+			err = mtb.setMaintenance(true)
+		case "off":
+			err = mtb.setMaintenance(false)
+		default:
+			msg.Text = fmt.Sprintf("Maintenance: %t\n\nToggle with: /admin maintenance on|off", mtb.isMaintenance())
+			return mtb.reply(msg)
+		}
+		if err != nil {
+			msg.Text = fmt.Sprintf("Error while saving maintenance mode: %s", err)
+			return mtb.reply(msg)
+		}
+		mtb.auditAdmin(fmt.Sprintf("maintenance %s", arg))
+		msg.Text = fmt.Sprintf("Maintenance mode %s.", arg)
+	case "health":
+		healthmutex.Lock()
+		health := mtb.health
+		healthmutex.Unlock()
+		if health == nil {
+			msg.Text = "No health check yet."
+			return mtb.reply(msg)
+		}
+		mtb.auditAdmin("health")
+		msg.Text = health.String()
+	case "audit":
+		return mtb.parseCommandADMINAUDIT(msg, arg)
+	case "groups":
+		return mtb.parseCommandADMINGROUPS(msg, arg)
+	case "pending":
+		approvalsmutex.Lock()
+		msg.Text = fmt.Sprintf("Pending approvals: %d", len(mtb.approvals))
+		for _, approval := range mtb.approvals {
+			msg.Text = fmt.Sprintf("%s\n\n%s", msg.Text, approval)
+		}
+		approvalsmutex.Unlock()
+		mtb.auditAdmin("pending")
+	default:
+		msg.Text = "Usage:\n/admin stats\n/admin user ID|@username|#index\n/admin freeze ID|@username|#index reason\n/admin unfreeze ID|@username|#index\n/admin broadcast message\n/admin maintenance on|off\n/admin pending\n/admin health\n/admin audit verify\n/admin audit export [USERID] [FROM] [TO]\n/admin groups [GROUPID|export]"
+	}
+
+	return mtb.reply(msg)
+}
@@ -0,0 +1,378 @@
+package monerotipbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omani/go-monero-rpc-client/wallet"
+	"github.com/spf13/viper"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const (
+	approvalKindSend     = "send"
+	approvalKindWithdraw = "withdraw"
+)
+
+var approvalsmutex sync.Mutex
+
+// loadApprovals reads all pending approvals from APPROVALS_FILE. A missing file means nothing is pending.
+func loadApprovals() ([]*Approval, error) {
+	var approvals []*Approval
+
+	file, err := ioutil.ReadFile(viper.GetString("APPROVALS_FILE"))
+	if err != nil {
+		return approvals, nil
+	}
+
+	err = json.Unmarshal(file, &approvals)
+	if err != nil {
+		return nil, err
+	}
+
+	return approvals, nil
+}
+
+// saveApprovalsToFile must be called with approvalsmutex held
+func (mtb *MoneroTipBot) saveApprovalsToFile() error {
+	mtb.metricGauge("approvals.pending", float64(len(mtb.approvals)))
+
+	file, err := json.MarshalIndent(mtb.approvals, "", " ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(viper.GetString("APPROVALS_FILE"), file, 0600)
+}
+
+// needsApproval reports whether amount is above APPROVAL_THRESHOLD
+func needsApproval(amount uint64) bool {
+	threshold := wallet.Float64ToXMR(viper.GetFloat64("APPROVAL_THRESHOLD"))
+	return threshold > 0 && amount > threshold
+}
+
+// findApproval must be called with approvalsmutex held
+func (mtb *MoneroTipBot) findApproval(id int64) (int, *Approval) {
+	for i, approval := range mtb.approvals {
+		if approval.ID == id {
+			return i, approval
+		}
+	}
+	return -1, nil
+}
+
+// removeApproval must be called with approvalsmutex held
+func (mtb *MoneroTipBot) removeApproval(i int) error {
+	mtb.approvals = append(mtb.approvals[:i], mtb.approvals[i+1:]...)
+	return mtb.saveApprovalsToFile()
+}
+
+func (approval *Approval) String() string {
+	amount := fmt.Sprintf("%f XMR", wallet.XMRToFloat64(approval.Amount))
+	if approval.Kind == approvalKindWithdraw {
+		amount = fmt.Sprintf("all, at most %f XMR (the balance at request time)", wallet.XMRToFloat64(approval.Amount))
+	}
+	return fmt.Sprintf("Approval #%d: %s\n\nUser: @%s (%d)\nAccount: #%d\nAmount: %s\nAddress: %s\nRequested: %s", approval.ID, approval.Kind, approval.Username, approval.UserID, approval.AccountIndex, amount, approval.Address, approval.Created.Format(time.RFC1123))
+}
+
+// queueApproval parks a send or withdrawal of the current user and asks the admins in ADMIN_CHAT_ID to approve or reject it
+func (mtb *MoneroTipBot) queueApproval(kind string, useraccount *Account, address string, amount uint64, priority wallet.Priority) error {
+	msg := mtb.newReplyMessage(true)
+
+	approvalsmutex.Lock()
+	defer approvalsmutex.Unlock()
+
+	for _, approval := range mtb.approvals {
+		if approval.UserID == int64(mtb.from.ID) {
+			msg.Text = fmt.Sprintf("You already have a request waiting for approval (#%d). Please wait until it has been processed.", approval.ID)
+			return mtb.reply(msg)
+		}
+	}
+
+	approval := &Approval{
+		ID:           time.Now().UnixNano() / int64(time.Millisecond),
+		Kind:         kind,
+		UserID:       int64(mtb.from.ID),
+		Username:     mtb.getUsername(),
+		ChatID:       mtb.getReplyID(),
+		AccountIndex: useraccount.AccountIndex,
+		Address:      address,
+		Amount:       amount,
+		Priority:     priority,
+		Created:      time.Now(),
+	}
+
+	adminchat := viper.GetInt64("ADMIN_CHAT_ID")
+	if adminchat != 0 {
+		approve := tgbotapi.NewInlineKeyboardButtonData("Approve", fmt.Sprintf("approval_approve_%d", approval.ID))
+		reject := tgbotapi.NewInlineKeyboardButtonData("Reject", fmt.Sprintf("approval_reject_%d", approval.ID))
+		adminmsg := tgbotapi.NewMessage(adminchat, fmt.Sprintf("%s\n\nReject with a reason: /reject %d REASON", approval, approval.ID))
+		adminmsg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(approve, reject))
+		resp, err := mtb.sendWait(adminmsg)
+		if err != nil {
+			msg.Text = fmt.Sprintf("Error while queueing your request: %s", err)
+			return mtb.reply(msg)
+		}
+		approval.MessageID = resp.MessageID
+	}
+
+	mtb.approvals = append(mtb.approvals, approval)
+	err := mtb.saveApprovalsToFile()
+	if err != nil {
+		return err
+	}
+	mtb.metricIncr("approvals_queued.counter", 1)
+
+	entry := mtb.newAuditEntry("approval_queued")
+	entry.AccountIndex = approval.AccountIndex
+	entry.Counterparty = approval.Address
+	entry.Amount = approval.Amount
+	entry.Details = fmt.Sprintf("approval #%d (%s)", approval.ID, approval.Kind)
+	mtb.audit(entry)
+
+	msg.Text = fmt.Sprintf("Amounts above %f XMR need the approval of an admin. Your %s is pending (#%d). You will be notified once it has been processed.", viper.GetFloat64("APPROVAL_THRESHOLD"), kind, approval.ID)
+	return mtb.reply(msg)
+}
+
+// executeApproval sends the funds of an approved request
+func (mtb *MoneroTipBot) executeApproval(approval *Approval) (string, error) {
+	start := time.Now()
+
+	// the funds of the requesting user move. the admin goes into the details.
+	entry := mtb.newAuditEntry(approval.Kind)
+	entry.UserID = approval.UserID
+	entry.Username = approval.Username
+	entry.ChatID = approval.ChatID
+	entry.AccountIndex = approval.AccountIndex
+	entry.Counterparty = approval.Address
+	entry.Details = fmt.Sprintf("approval #%d approved by @%s (%d)", approval.ID, mtb.getUsername(), mtb.from.ID)
+
+	if approval.Kind == approvalKindWithdraw {
+		balance, err := mtb.walletrpc.GetBalance(&wallet.RequestGetBalance{AccountIndex: approval.AccountIndex})
+		if err != nil {
+			mtb.audit(entry.fail(err))
+			return "", err
+		}
+		// deposits after the request were not approved. only the approved amount leaves, the rest stays.
+		if balance.UnlockedBalance+mtb.coldBalance(approval.AccountIndex) > approval.Amount {
+			entry.Details = fmt.Sprintf("%s, capped at the approved amount", entry.Details)
+			return mtb.executeTransfer(approval, entry, start)
+		}
+
+		withdrawal, err := mtb.withdrawAll(approval.AccountIndex, approval.Address, approval.Priority)
+		entry.Amount = withdrawal.Amount
+		entry.Fee = withdrawal.Fee
+		entry.TxHash = strings.Join(withdrawal.TxHashes, ",")
+		if err != nil {
+			mtb.audit(entry.fail(err))
+			if len(withdrawal.TxHashes) > 0 {
+				return "", fmt.Errorf("%s. Sent so far:\n%s", err, withdrawal)
+			}
+			return "", err
+		}
+		mtb.metricTiming("transaction.time_to_complete", time.Since(start))
+		mtb.metricIncr("transactions.counter", 1)
+		mtb.audit(entry)
+		return withdrawal.String(), nil
+	}
+
+	return mtb.executeTransfer(approval, entry, start)
+}
+
+// executeTransfer sends the approved amount of approval and audits it with entry
+func (mtb *MoneroTipBot) executeTransfer(approval *Approval, entry *AuditEntry, start time.Time) (string, error) {
+	resp, err := mtb.transferFrom(approval.AccountIndex, []*wallet.Destination{{Amount: approval.Amount, Address: approval.Address}}, approval.Priority)
+	entry.Amount = approval.Amount
+	if err != nil {
+		mtb.audit(entry.fail(err))
+		return "", err
+	}
+	mtb.metricTiming("transaction.time_to_complete", time.Since(start))
+	mtb.metricIncr("transactions.counter", 1)
+	entry.Fee = resp.Fee
+	entry.TxHash = resp.TxHash
+	mtb.audit(entry)
+	// withdrawals don't count towards the daily limits
+	if approval.Kind == approvalKindSend {
+		mtb.recordSpending(approval.UserID, approval.Amount, false)
+	}
+	return fmt.Sprintf("Amount: %f\nFee: %f\nTxHash: <a href='%s%s'>%s</a>", wallet.XMRToFloat64(resp.Amount), wallet.XMRToFloat64(resp.Fee), viper.GetString("blockexplorer_url"), resp.TxHash, resp.TxHash), nil
+}
+
+// approve executes the approval with id and notifies the user. The returned text is the outcome for the admins.
+func (mtb *MoneroTipBot) approve(id int64) (string, error) {
+	approvalsmutex.Lock()
+	defer approvalsmutex.Unlock()
+
+	i, approval := mtb.findApproval(id)
+	if approval == nil {
+		return "", fmt.Errorf("Approval #%d not found. It may have been processed already.", id)
+	}
+	// keep it queued during maintenance or while the account is frozen
+	err := mtb.checkTransfer(approval.AccountIndex)
+	if err != nil {
+		return "", err
+	}
+	// remove it first. a failed transfer must not be approved twice by accident.
+	err = mtb.removeApproval(i)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := mtb.executeApproval(approval)
+	if err != nil {
+		mtb.metricIncr("approvals_failed.counter", 1)
+		mtb.reply(&Message{
+			Format: true,
+			ChatID: approval.ChatID,
+			Text:   fmt.Sprintf("Your %s (#%d) has been approved, but failed: %s", approval.Kind, approval.ID, err),
+		})
+		return fmt.Sprintf("%s\n\n...Approved by @%s, but failed: %s", approval, mtb.getUsername(), html.EscapeString(err.Error())), nil
+	}
+	mtb.metricIncr("approvals_approved.counter", 1)
+
+	mtb.reply(&Message{
+		Format:  true,
+		ChatID:  approval.ChatID,
+		Text:    fmt.Sprintf("Your %s (#%d) to address %s has been approved.", approval.Kind, approval.ID, approval.Address),
+		Receipt: true,
+	})
+	mtb.reply(&Message{
+		ChatID:  approval.ChatID,
+		Text:    result,
+		Receipt: true,
+	})
+
+	return fmt.Sprintf("%s\n\n...Approved by @%s.\n%s", approval, mtb.getUsername(), result), nil
+}
+
+// reject drops the approval with id and passes reason back to the user. The returned text is the outcome for the admins.
+func (mtb *MoneroTipBot) reject(id int64, reason string) (string, error) {
+	approvalsmutex.Lock()
+	defer approvalsmutex.Unlock()
+
+	i, approval := mtb.findApproval(id)
+	if approval == nil {
+		return "", fmt.Errorf("Approval #%d not found. It may have been processed already.", id)
+	}
+	err := mtb.removeApproval(i)
+	if err != nil {
+		return "", err
+	}
+	mtb.metricIncr("approvals_rejected.counter", 1)
+
+	if len(reason) == 0 {
+		reason = "No reason given."
+	}
+
+	entry := mtb.newAuditEntry("approval_rejected")
+	entry.UserID = approval.UserID
+	entry.Username = approval.Username
+	entry.AccountIndex = approval.AccountIndex
+	entry.Counterparty = approval.Address
+	entry.Amount = approval.Amount
+	entry.Details = fmt.Sprintf("approval #%d rejected by @%s (%d): %s", approval.ID, mtb.getUsername(), mtb.from.ID, reason)
+	mtb.audit(entry)
+	mtb.reply(&Message{
+		Format: true,
+		ChatID: approval.ChatID,
+		Text:   fmt.Sprintf("Your %s (#%d) has been rejected by an admin.\n\nReason: %s", approval.Kind, approval.ID, reason),
+	})
+
+	return fmt.Sprintf("%s\n\n...Rejected by @%s.\nReason: %s", approval, mtb.getUsername(), html.EscapeString(reason)), nil
+}
+
+// editApprovalMessage replaces the Approve/Reject buttons in ADMIN_CHAT_ID with the outcome
+func (mtb *MoneroTipBot) editApprovalMessage(messageid int, text string) {
+	adminchat := viper.GetInt64("ADMIN_CHAT_ID")
+	if adminchat == 0 || messageid == 0 {
+		return
+	}
+	edit := tgbotapi.NewEditMessageText(adminchat, messageid, text)
+	edit.ParseMode = "HTML"
+	mtb.send(edit)
+}
+
+func (mtb *MoneroTipBot) processApproval() error {
+	if !mtb.isAdmin() {
+		mtb.bot.AnswerCallbackQuery(tgbotapi.CallbackConfig{
+			CallbackQueryID: mtb.callback.ID,
+			Text:            "Only admins can do this.",
+			ShowAlert:       true,
+		})
+		return nil
+	}
+
+	split := strings.Split(mtb.callback.Data, "_")
+	if len(split) != 3 {
+		return fmt.Errorf("Could not parse CallbackQuery")
+	}
+	id, err := strconv.ParseInt(split[2], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	var result string
+	switch split[1] {
+	case "approve":
+		result, err = mtb.approve(id)
+	case "reject":
+		result, err = mtb.reject(id, "")
+	default:
+		return fmt.Errorf("Could not parse CallbackQuery")
+	}
+	if err != nil {
+		mtb.bot.AnswerCallbackQuery(tgbotapi.CallbackConfig{
+			CallbackQueryID: mtb.callback.ID,
+			Text:            err.Error(),
+			ShowAlert:       true,
+		})
+		return err
+	}
+
+	mtb.editApprovalMessage(mtb.callback.Message.MessageID, result)
+	return nil
+}
+
+func (mtb *MoneroTipBot) parseCommandREJECT() error {
+	msg := mtb.newReplyMessage(true)
+	msg.ChatID = mtb.message.Chat.ID
+
+	if !mtb.isAdmin() {
+		msg.Text = "This command is only available to admins."
+		return mtb.reply(msg)
+	}
+
+	split := strings.SplitN(strings.TrimSpace(mtb.message.CommandArguments()), " ", 2)
+	id, err := strconv.ParseInt(split[0], 10, 64)
+	if err != nil {
+		msg.Text = "Please specify the approval id (with optional reason): /reject ID your reason goes here"
+		return mtb.reply(msg)
+	}
+	var reason string
+	if len(split) > 1 {
+		reason = strings.TrimSpace(split[1])
+	}
+
+	approvalsmutex.Lock()
+	_, approval := mtb.findApproval(id)
+	approvalsmutex.Unlock()
+
+	result, err := mtb.reject(id, reason)
+	if err != nil {
+		msg.Text = err.Error()
+		return mtb.reply(msg)
+	}
+	if approval != nil {
+		mtb.editApprovalMessage(approval.MessageID, result)
+	}
+
+	msg.Text = fmt.Sprintf("Approval #%d rejected.", id)
+	return mtb.reply(msg)
+}
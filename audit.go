@@ -0,0 +1,260 @@
+package monerotipbot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const auditOutcomeOK = "ok"
+
+var auditmutex sync.Mutex
+
+// computeHash hashes the entry (including PrevHash) with an empty Hash
+func (entry *AuditEntry) computeHash() (string, error) {
+	unhashed := *entry
+	unhashed.Hash = ""
+
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readAuditLog calls fn for every entry in AUDIT_LOG_FILE in order. A missing file means an empty log.
+func readAuditLog(fn func(line int, entry *AuditEntry) error) error {
+	file, err := os.Open(viper.GetString("AUDIT_LOG_FILE"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		entry := &AuditEntry{}
+		err = json.Unmarshal(scanner.Bytes(), entry)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		err = fn(line, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// loadAuditLog returns the sequence number and hash of the last entry in AUDIT_LOG_FILE
+func loadAuditLog() (uint64, string, error) {
+	var seq uint64
+	var hash string
+	err := readAuditLog(func(line int, entry *AuditEntry) error {
+		seq = entry.Seq
+		hash = entry.Hash
+		return nil
+	})
+	return seq, hash, err
+}
+
+// VerifyAuditLog walks the whole chain and returns the number of entries and the hash of the last one,
+// or the first broken link
+func VerifyAuditLog() (int, string, error) {
+	var prev string
+	var seq uint64
+	count := 0
+	err := readAuditLog(func(line int, entry *AuditEntry) error {
+		seq++
+		if entry.Seq != seq {
+			return fmt.Errorf("line %d: expected entry #%d, found #%d. Entries were removed or reordered", line, seq, entry.Seq)
+		}
+		if entry.PrevHash != prev {
+			return fmt.Errorf("line %d (entry #%d): link to the previous entry is broken", line, entry.Seq)
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return err
+		}
+		if entry.Hash != hash {
+			return fmt.Errorf("line %d (entry #%d): entry was modified", line, entry.Seq)
+		}
+		prev = entry.Hash
+		count++
+		return nil
+	})
+	return count, prev, err
+}
+
+// newAuditEntry prefills an entry with the current user and chat
+func (mtb *MoneroTipBot) newAuditEntry(action string) *AuditEntry {
+	entry := &AuditEntry{
+		Action:  action,
+		Outcome: auditOutcomeOK,
+	}
+	if mtb.from != nil {
+		entry.UserID = int64(mtb.from.ID)
+		entry.Username = mtb.from.UserName
+	}
+	if mtb.message != nil && mtb.message.Chat != nil {
+		entry.ChatID = mtb.message.Chat.ID
+	}
+	return entry
+}
+
+// fail records err as the outcome of the entry
+func (entry *AuditEntry) fail(err error) *AuditEntry {
+	entry.Outcome = fmt.Sprintf("error: %s", err)
+	return entry
+}
+
+// audit appends entry to AUDIT_LOG_FILE. The action already happened, so errors are only logged.
+func (mtb *MoneroTipBot) audit(entry *AuditEntry) {
+	auditmutex.Lock()
+	defer auditmutex.Unlock()
+
+	entry.Seq = mtb.auditseq + 1
+	entry.Time = time.Now().UTC()
+	entry.PrevHash = mtb.audithash
+
+	hash, err := entry.computeHash()
+	if err != nil {
+		mtb.logger().WithError(err).WithField("action", entry.Action).Error("Error while writing audit log")
+		return
+	}
+	entry.Hash = hash
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		mtb.logger().WithError(err).WithField("action", entry.Action).Error("Error while writing audit log")
+		return
+	}
+
+	file, err := os.OpenFile(viper.GetString("AUDIT_LOG_FILE"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		mtb.logger().WithError(err).WithField("action", entry.Action).Error("Error while writing audit log")
+		return
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		mtb.logger().WithError(err).WithField("action", entry.Action).Error("Error while writing audit log")
+		return
+	}
+
+	mtb.auditseq = entry.Seq
+	mtb.audithash = entry.Hash
+}
+
+// ExportAuditLog returns the entries of userid (0 for all users) between from and to as JSONL
+func ExportAuditLog(userid int64, from, to time.Time) ([]byte, int, error) {
+	var out bytes.Buffer
+	count := 0
+	err := readAuditLog(func(line int, entry *AuditEntry) error {
+		if userid != 0 && entry.UserID != userid {
+			return nil
+		}
+		if entry.Time.Before(from) || !entry.Time.Before(to) {
+			return nil
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		out.Write(data)
+		out.WriteByte('\n')
+		count++
+		return nil
+	})
+	return out.Bytes(), count, err
+}
+
+// parseCommandADMINAUDIT handles /admin audit verify and /admin audit export [USERID] [FROM] [TO]
+func (mtb *MoneroTipBot) parseCommandADMINAUDIT(msg *Message, arg string) error {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		msg.Text = "Usage:\n/admin audit verify\n/admin audit export [USERID] [FROM] [TO]\n\nFROM and TO are UTC days (YYYY-MM-DD). TO is inclusive."
+		return mtb.reply(msg)
+	}
+
+	switch fields[0] {
+	case "verify":
+		mtb.auditAdmin("audit verify")
+
+		auditmutex.Lock()
+		count, last, err := VerifyAuditLog()
+		auditmutex.Unlock()
+		if err != nil {
+			mtb.logger().WithError(err).Error("Audit log verification failed")
+			msg.Text = fmt.Sprintf("Audit log is NOT intact!\n\n%s", err)
+			return mtb.reply(msg)
+		}
+		// entries cut off at the end can't be detected from the file alone. keep the last hash somewhere else.
+		msg.Text = fmt.Sprintf("Audit log is intact. %d entries verified.\n\nLast hash: %s", count, last)
+		return mtb.reply(msg)
+	case "export":
+		var userid int64
+		from := time.Time{}
+		to := time.Now().UTC().Add(time.Hour)
+		var dates []time.Time
+		for _, field := range fields[1:] {
+			if day, err := time.Parse("2006-01-02", field); err == nil {
+				dates = append(dates, day)
+				continue
+			}
+			id, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				msg.Text = fmt.Sprintf("Could not parse %q. Use a user id or a day (YYYY-MM-DD).", field)
+				return mtb.reply(msg)
+			}
+			userid = id
+		}
+		if len(dates) > 0 {
+			from = dates[0]
+		}
+		if len(dates) > 1 {
+			to = dates[1].AddDate(0, 0, 1)
+		}
+		mtb.auditAdmin(fmt.Sprintf("audit export %s", strings.Join(fields[1:], " ")))
+
+		auditmutex.Lock()
+		data, count, err := ExportAuditLog(userid, from, to)
+		auditmutex.Unlock()
+		if err != nil {
+			msg.Text = fmt.Sprintf("Error while exporting the audit log: %s", err)
+			return mtb.reply(msg)
+		}
+		if count == 0 {
+			msg.Text = "No audit log entries found."
+			return mtb.reply(msg)
+		}
+
+		msg.Text = fmt.Sprintf("%d audit log entries exported.", count)
+		mtb.reply(msg)
+		document := tgbotapi.NewDocumentUpload(msg.ChatID, tgbotapi.FileBytes{Name: "audit.jsonl", Bytes: data})
+		mtb.send(document)
+		return nil
+	}
+
+	msg.Text = "Unknown audit subcommand. Use verify or export."
+	return mtb.reply(msg)
+}
@@ -7,45 +7,92 @@ import (
 	"image"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/gabstv/httpdigest"
 	"github.com/makiuchi-d/gozxing"
 	"github.com/makiuchi-d/gozxing/qrcode"
 	"github.com/omani/go-monero-rpc-client/wallet"
 	zmq "github.com/pebbe/zmq4"
-	statsd "github.com/smira/go-statsd"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
 
 // MoneroTipBot is out Monero Tip Bot
 type MoneroTipBot struct {
-	walletrpc    wallet.Client
+	walletrpc    *resilientWallet
 	bot          *tgbotapi.BotAPI
 	message      *tgbotapi.Message
 	callback     *tgbotapi.CallbackQuery
 	from         *tgbotapi.User
 	giveaways    []*Giveaway
 	qrcodes      []*QRCode
+	whitelists   map[int64]*Whitelist
+	limits       map[int64]*Limits
+	reserveproof *ReserveProof
 	rpcchannel   *zmq.Socket
-	statsdclient *statsd.Client
+	metrics      *Metrics
+	outbox       *Outbox
+
+	secondfactors        map[int64]*SecondFactor
+	pendingconfirmations map[int64]*PendingConfirmation
+	// secondfactorverified is set while replaying a request confirmed with /confirm
+	secondfactorverified bool
+
+	coldallocations map[uint64]uint64
+	refillrequested bool
+
+	// feeestimate is the last estimate of /fee, the fallback while the primary account has nothing unlocked
+	feeestimate *FeeEstimate
+
+	approvals []*Approval
+
+	// maintenance disables all transfers while set
+	maintenance    bool
+	frozenaccounts map[uint64]*FrozenAccount
+
+	// health is the result of the last health check. nil until the first check
+	health *Health
+
+	// auditseq and audithash are the sequence number and hash of the last audit log entry
+	auditseq  uint64
+	audithash string
+
+	// shutdown is closed by Shutdown, stopped by Run when the update loop ended.
+	// inflight counts background work that moves funds.
+	shutdown chan struct{}
+	stopped  chan struct{}
+	stopping bool
+	inflight sync.WaitGroup
+
+	// webhook is the listener for updates in webhook mode
+	webhook *http.Server
+
+	// updatelog carries the correlation ID of the update being processed, see logger()
+	updatelog   *logrus.Entry
+	updatestart time.Time
+
+	// groups is the registry of the groups the bot is used in. groupsdirty is set until it's saved
+	groups      map[int64]*Group
+	groupsdirty bool
+
+	// deletions are the group messages waiting to be cleaned up
+	deletions []*Deletion
+
+	// ratelimits are the token buckets per user and chat, see isThrottled()
+	ratelimits      map[string]*tokenBucket
+	ratelimitpruned time.Time
 }
 
-var (
-	usernameregexp *regexp.Regexp
-	mutex          sync.RWMutex
-)
+var usernameregexp *regexp.Regexp
 
 // NewBot creates a new monerotipbot instance
 func NewBot(conf *Config) (*MoneroTipBot, error) {
@@ -55,13 +102,19 @@ func NewBot(conf *Config) (*MoneroTipBot, error) {
 		configpath = filepath.Join(os.Getenv("HOME"), "settings.toml")
 	}
 
+	// never send user identities to the metrics backends or the logs, unless explicitly turned off
+	viper.SetDefault("METRICS_PRIVACY", true)
+	viper.SetDefault("LOG_REDACT", true)
+	viper.SetDefault("LOG_LEVEL", "info")
+	viper.SetDefault("LOG_STDOUT", true)
+
 	// parse the monerotipbot config file
 	viper.SetConfigType("yaml")
 	viper.SetConfigName(strings.TrimSuffix(path.Base(configpath), path.Ext(configpath)))
 	viper.AddConfigPath(path.Dir(configpath))
 	viper.WatchConfig()
 	viper.OnConfigChange(func(e fsnotify.Event) {
-		fmt.Println("Config file changed:", e.Name)
+		logrus.WithField("file", e.Name).Info("Config file changed")
 	})
 
 	err := viper.ReadInConfig()
@@ -69,13 +122,21 @@ func NewBot(conf *Config) (*MoneroTipBot, error) {
 		return nil, err
 	}
 
-	bot, err := tgbotapi.NewBotAPI(viper.GetString("telegram_bot_token"))
+	err = setupLogging()
+	if err != nil {
+		return nil, err
+	}
+	if conf.GetDebug() {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	bot, err := newBotAPI()
 	if err != nil {
 		return nil, err
 	}
 
 	if conf.GetDebug() {
-		log.Printf("Authorized on account %s", bot.Self.UserName)
+		logrus.WithField("bot", bot.Self.UserName).Info("Authorized on account")
 		bot.Debug = true
 	}
 
@@ -97,20 +158,83 @@ func NewBot(conf *Config) (*MoneroTipBot, error) {
 		}
 	}
 
-	self := &MoneroTipBot{
-		bot:       bot,
-		giveaways: giveaways,
-		// start a wallet client instance with login if login specified in settings
-		walletrpc: wallet.New(wallet.Config{
-			Address:   viper.GetString("monero_rpc_daemon_url"),
-			Transport: httpdigest.New(viper.GetString("monero_rpc_daemon_username"), viper.GetString("monero_rpc_daemon_password")),
-		}),
+	whitelists, err := loadWhitelists()
+	if err != nil {
+		return nil, err
 	}
 
-	if viper.GetBool("USE_STATSD") {
-		// initiate statsd client
-		self.statsdclient = statsd.NewClient(viper.GetString("statsd_address"), statsd.MetricPrefix(viper.GetString("statsd_prefix")), statsd.SendLoopCount(10), statsd.MaxPacketSize(100000))
+	secondfactors, err := loadSecondFactors()
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := loadLimits()
+	if err != nil {
+		return nil, err
 	}
+
+	reserveproof, err := loadReserveProof()
+	if err != nil {
+		return nil, err
+	}
+
+	coldallocations, err := loadColdAllocations()
+	if err != nil {
+		return nil, err
+	}
+
+	approvals, err := loadApprovals()
+	if err != nil {
+		return nil, err
+	}
+
+	maintenance, frozenaccounts, err := loadOperatorState()
+	if err != nil {
+		return nil, err
+	}
+
+	auditseq, audithash, err := loadAuditLog()
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := loadGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	deletions, err := loadDeletions()
+	if err != nil {
+		return nil, err
+	}
+
+	self := &MoneroTipBot{
+		bot:                  bot,
+		giveaways:            giveaways,
+		whitelists:           whitelists,
+		limits:               limits,
+		reserveproof:         reserveproof,
+		coldallocations:      coldallocations,
+		approvals:            approvals,
+		secondfactors:        secondfactors,
+		pendingconfirmations: make(map[int64]*PendingConfirmation),
+		maintenance:          maintenance,
+		frozenaccounts:       frozenaccounts,
+		auditseq:             auditseq,
+		audithash:            audithash,
+		groups:               groups,
+		deletions:            deletions,
+		ratelimits:           make(map[string]*tokenBucket),
+		shutdown:             make(chan struct{}),
+		stopped:              make(chan struct{}),
+	}
+
+	// statsd and prometheus
+	self.metrics = newMetrics()
+	// everything sent to telegram goes through the outbox
+	self.outbox = newOutbox(bot, self.metrics)
+	// start a wallet client instance with login if login specified in settings
+	self.walletrpc = newResilientWallet(self.metrics, self.logger)
 	// initiate zmq channel for rpc calls to this bot (for now only for broadcasting messages to users)
 	responder, _ := zmq.NewSocket(zmq.REP)
 	responder.Bind(viper.GetString("rpcchannel_uri"))
@@ -121,48 +245,77 @@ func NewBot(conf *Config) (*MoneroTipBot, error) {
 
 // Run starts the bot in a loop
 func (mtb *MoneroTipBot) Run() error {
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-	updates, err := mtb.bot.GetUpdatesChan(u)
+	defer close(mtb.stopped)
+
+	updates, err := mtb.getUpdates()
+	if err != nil {
+		return err
+	}
+
+	// serve the prometheus metrics on METRICS_LISTEN
+	err = mtb.metrics.listen()
 	if err != nil {
 		return err
 	}
+	mtb.metricGauge("giveaways.open", float64(len(mtb.giveaways)))
+	approvalsmutex.Lock()
+	mtb.metricGauge("approvals.pending", float64(len(mtb.approvals)))
+	approvalsmutex.Unlock()
 
-	// track in how many groups this bot is actually used in.
-	// in your code editor, search the above comment (whole line) to see what I do with the groupsBotIsIn variable.
-	groupsBotIsIn := make(map[int64]*tgbotapi.Chat)
-	go groupTrackerLogger(groupsBotIsIn)
+	// save the group registry and gauge the groups the bot is in
+	go mtb.groupsScheduler()
+
+	// delete ephemeral bot replies and commands in groups after CLEANUP_MESSAGE_DELAY and CLEANUP_COMMAND_DELAY
+	go mtb.cleanupScheduler()
 
 	// listen on the ZMQ socket for notifications
 	go mtb.listenRPC()
-	defer mtb.rpcchannel.Close()
 
-	for update := range updates {
+	// apply time-locked whitelist changes once they are due
+	go mtb.whitelistScheduler()
+
+	// publish a proof of reserves every RESERVES_INTERVAL hours
+	go mtb.reservesScheduler()
+
+	// report discrepancies between wallet accounts and users to the admins
+	go mtb.reconciliationScheduler()
+
+	// watch the wallet and the daemon. transfers are refused while unhealthy.
+	go mtb.healthScheduler()
+
+	// keep the hot wallet between HOT_WALLET_FLOOR and HOT_WALLET_CEILING
+	go mtb.coldWalletScheduler()
+
+	// save the wallet every WALLET_STORE_INTERVAL seconds. Shutdown saves it a last time.
+	go mtb.walletStoreScheduler()
+
+	for update := range mtb.receiveUpdates(updates) {
+		mtb.beginUpdate(update)
+
 		if update.Message != nil {
 			// log the event of the bot joining a group
 			if update.Message.NewChatMembers != nil {
 				for _, member := range *update.Message.NewChatMembers {
 					if member.UserName == viper.GetString("BOT_NAME") && member.IsBot {
-						mtb.statsdIncr("bot_group_join.counter", 1)
+						mtb.metricIncr("bot_group_join.counter", 1)
+						mtb.groupJoined(update.Message.Chat)
 					}
 				}
 			}
 			// log the event of the bot leaving (being kicked out of) a group
 			if update.Message.LeftChatMember != nil {
 				if update.Message.LeftChatMember.UserName == viper.GetString("BOT_NAME") && update.Message.LeftChatMember.IsBot {
-					mtb.statsdIncr("bot_group_left.counter", 1)
+					mtb.metricIncr("bot_group_left.counter", 1)
+					mtb.groupLeft(update.Message.Chat)
 				}
 			}
 
-			// track in how many groups this bot is actually used in
-			if update.Message.Chat != nil {
-				mutex.Lock()
-				groupsBotIsIn[update.Message.Chat.ID] = update.Message.Chat
-				mutex.Unlock()
-			}
+			// track the activity in the groups this bot is used in
+			mtb.trackGroupMessage(update.Message.Chat, update.Message.From)
 
 			// bots are not allowed to talk to us.
 			if update.Message.From.IsBot {
+				mtb.destroy()
 				continue
 			}
 
@@ -178,6 +331,7 @@ func (mtb *MoneroTipBot) Run() error {
 			// notice: we check on the FROM object, not the Message object!
 			// on a callback the Message object will always be from the bot!
 			if update.CallbackQuery.From.IsBot {
+				mtb.destroy()
 				continue
 			}
 			iscallback = true
@@ -200,6 +354,15 @@ func (mtb *MoneroTipBot) Run() error {
 					continue
 				}
 
+				// don't leave the commands in the group forever
+				mtb.cleanupCommand()
+
+				// anti-flood
+				if mtb.isThrottled() {
+					mtb.destroy()
+					continue
+				}
+
 				// request pre-checks
 				err := mtb.requestPreCheck()
 				if err != nil {
@@ -215,6 +378,11 @@ func (mtb *MoneroTipBot) Run() error {
 			} else {
 				// check if we received a photo (possibly a qr-code)
 				if mtb.message.Photo != nil {
+					// decoding is expensive. anti-flood
+					if mtb.isThrottled() {
+						mtb.destroy()
+						continue
+					}
 					err = mtb.parsePhoto()
 					if err != nil {
 						mtb.destroy()
@@ -226,6 +394,12 @@ func (mtb *MoneroTipBot) Run() error {
 
 		// not a command? then handle callbackqueries here
 		if mtb.callback != nil {
+			// anti-flood
+			if mtb.isThrottled() {
+				mtb.destroy()
+				continue
+			}
+
 			// request pre-checks
 			err := mtb.requestPreCheck()
 			if err != nil {
@@ -247,6 +421,13 @@ func (mtb *MoneroTipBot) Run() error {
 					continue
 				}
 			}
+			if strings.HasPrefix(mtb.callback.Data, "approval_") {
+				err = mtb.processApproval()
+				if err != nil {
+					mtb.destroy()
+					continue
+				}
+			}
 		}
 
 		/*
@@ -264,12 +445,10 @@ func (mtb *MoneroTipBot) destroy() {
 	mtb.message = nil
 	mtb.callback = nil
 	mtb.from = nil
-	// save the wallet (IMPORTANT!)
-	mtb.walletrpc.Store()
+	mtb.secondfactorverified = false
+	mtb.endUpdate()
 	// // destroy ZMQ socket
 	// mtb.rpcchannel.Close()
-	// // destroy statsdclient
-	// mtb.statsdclient.Close()
 }
 
 func (mtb *MoneroTipBot) hasUserNameHandle() bool {
@@ -290,6 +469,7 @@ func (mtb *MoneroTipBot) hasUserNameHandle() bool {
 	return true
 }
 
+// reply queues msg in the outbox and returns right away. msg.Done learns whether it arrived.
 func (mtb *MoneroTipBot) reply(msg *Message) error {
 	botmsg := tgbotapi.NewMessage(msg.ChatID, "")
 
@@ -301,9 +481,41 @@ func (mtb *MoneroTipBot) reply(msg *Message) error {
 		botmsg.Text = fmt.Sprintf("%s", msg.Text)
 	}
 
-	_, err := mtb.bot.Send(botmsg)
-	mtb.statsdIncr("botreplymessages.counter", 1)
-	return err
+	priority := priorityChatter
+	if msg.Receipt {
+		priority = priorityReceipt
+	}
+	// callers reuse msg for the next reply
+	sent := *msg
+	logger := sent.log
+	if logger == nil {
+		logger = mtb.logger()
+	}
+	logger = logger.WithField("reply_chat_id", msg.ChatID)
+	mtb.outbox.send(botmsg, priority, func(resp tgbotapi.Message, err error) {
+		if err != nil {
+			logger.WithError(err).Warn("Error while sending reply")
+		} else {
+			logger.Debug("Reply sent")
+			mtb.cleanupReply(&sent, resp)
+		}
+		if sent.Done != nil {
+			sent.Done(err)
+		}
+	})
+	mtb.metricIncr("botreplymessages.counter", 1)
+	return nil
+}
+
+// replyWait is reply for background jobs that need to know whether the message arrived. It blocks until then.
+func (mtb *MoneroTipBot) replyWait(msg *Message) error {
+	result := make(chan error, 1)
+	sent := *msg
+	sent.Done = func(err error) {
+		result <- err
+	}
+	mtb.reply(&sent)
+	return <-result
 }
 
 func (mtb *MoneroTipBot) requestPreCheck() error {
@@ -316,6 +528,9 @@ func (mtb *MoneroTipBot) requestPreCheck() error {
 	useraccount, err := mtb.getUserAccount()
 	if err != nil {
 		msg.Text = fmt.Sprintf("Error: %s", err)
+		if !mtb.isHealthy() {
+			msg.Text = viper.GetString("HEALTH_UNAVAILABLE_MESSAGE")
+		}
 		mtb.reply(msg)
 		return err
 	}
@@ -360,7 +575,7 @@ func (mtb *MoneroTipBot) createAccount() error {
 		return err
 	}
 	// stat account creation
-	mtb.statsdIncr("account_created.counter", 1)
+	mtb.metricIncr("account_created.counter", 1)
 
 	if mtb.message.Chat.IsPrivate() {
 		msg := &Message{
@@ -391,51 +606,156 @@ func (mtb *MoneroTipBot) parseCommand() error {
 			return mtb.reply(msg)
 		}
 		// stat this command invocation
-		mtb.statsdIncr("commands.START.counter", 1)
+		mtb.metricIncr("commands.*.counter", 1, label("command", "START"))
 		return mtb.parseCommandSTART()
 	case COMMANDS[HELP]:
 		if !mtb.message.Chat.IsPrivate() {
 			return mtb.reply(msg)
 		}
 		// stat this command invocation
-		mtb.statsdIncr("commands.HELP.counter", 1)
+		mtb.metricIncr("commands.*.counter", 1, label("command", "HELP"))
 		return mtb.parseCommandHELP()
 	case COMMANDS[TIP]:
 		// stat this command invocation
-		mtb.statsdIncr("commands.TIP.counter", 1)
+		mtb.metricIncr("commands.*.counter", 1, label("command", "TIP"))
+		if mtb.isCommandDisabled(COMMANDS[TIP]) {
+			msg.Text = "The admins of this group disabled /tip here."
+			return mtb.reply(msg)
+		}
+		err := mtb.checkOperational()
+		if err != nil {
+			msg.Text = err.Error()
+			return mtb.reply(msg)
+		}
 		return mtb.parseCommandTIP()
 	case COMMANDS[SEND]:
 		if !mtb.message.Chat.IsPrivate() {
 			return mtb.reply(msg)
 		}
 		// stat this command invocation
-		mtb.statsdIncr("commands.SEND.counter", 1)
+		mtb.metricIncr("commands.*.counter", 1, label("command", "SEND"))
+		err := mtb.checkOperational()
+		if err != nil {
+			msg.Text = err.Error()
+			return mtb.reply(msg)
+		}
 		return mtb.parseCommandSEND()
 	case COMMANDS[GIVEAWAY]:
 		// stat this command invocation
-		mtb.statsdIncr("commands.GIVEAWAY.counter", 1)
+		mtb.metricIncr("commands.*.counter", 1, label("command", "GIVEAWAY"))
+		if mtb.isCommandDisabled(COMMANDS[GIVEAWAY]) {
+			msg.Text = "The admins of this group disabled /giveaway here."
+			return mtb.reply(msg)
+		}
+		err := mtb.checkOperational()
+		if err != nil {
+			msg.Text = err.Error()
+			return mtb.reply(msg)
+		}
 		return mtb.parseCommandGIVEAWAY()
 	case COMMANDS[WITHDRAW]:
 		if !mtb.message.Chat.IsPrivate() {
 			return mtb.reply(msg)
 		}
 		// stat this command invocation
-		mtb.statsdIncr("commands.WITHDRAW.counter", 1)
+		mtb.metricIncr("commands.*.counter", 1, label("command", "WITHDRAW"))
+		err := mtb.checkOperational()
+		if err != nil {
+			msg.Text = err.Error()
+			return mtb.reply(msg)
+		}
 		return mtb.parseCommandWITHDRAW()
 	case COMMANDS[BALANCE]:
 		if !mtb.message.Chat.IsPrivate() {
 			return mtb.reply(msg)
 		}
 		// stat this command invocation
-		mtb.statsdIncr("commands.BALANCE.counter", 1)
+		mtb.metricIncr("commands.*.counter", 1, label("command", "BALANCE"))
 		return mtb.parseCommandBALANCE()
 	case COMMANDS[GENERATEQR]:
 		if !mtb.message.Chat.IsPrivate() {
 			return mtb.reply(msg)
 		}
 		// stat this command invocation
-		mtb.statsdIncr("commands.GENERATEQR.counter", 1)
+		mtb.metricIncr("commands.*.counter", 1, label("command", "GENERATEQR"))
 		return mtb.parseCommandGENERATEQR()
+	case COMMANDS[WHITELIST]:
+		if !mtb.message.Chat.IsPrivate() {
+			return mtb.reply(msg)
+		}
+		// stat this command invocation
+		mtb.metricIncr("commands.*.counter", 1, label("command", "WHITELIST"))
+		return mtb.parseCommandWHITELIST()
+	case COMMANDS[SECURITY]:
+		if !mtb.message.Chat.IsPrivate() {
+			return mtb.reply(msg)
+		}
+		// stat this command invocation
+		mtb.metricIncr("commands.*.counter", 1, label("command", "SECURITY"))
+		return mtb.parseCommandSECURITY()
+	case COMMANDS[CONFIRM]:
+		if !mtb.message.Chat.IsPrivate() {
+			return mtb.reply(msg)
+		}
+		// stat this command invocation
+		mtb.metricIncr("commands.*.counter", 1, label("command", "CONFIRM"))
+		return mtb.parseCommandCONFIRM()
+	case COMMANDS[LIMITS]:
+		if !mtb.message.Chat.IsPrivate() {
+			return mtb.reply(msg)
+		}
+		// stat this command invocation
+		mtb.metricIncr("commands.*.counter", 1, label("command", "LIMITS"))
+		return mtb.parseCommandLIMITS()
+	case COMMANDS[FEE]:
+		if !mtb.message.Chat.IsPrivate() {
+			return mtb.reply(msg)
+		}
+		// stat this command invocation
+		mtb.metricIncr("commands.*.counter", 1, label("command", "FEE"))
+		// the estimate is a transfer of the primary account, even if it's never relayed
+		err := mtb.checkTransfer(0)
+		if err != nil {
+			msg.Text = err.Error()
+			return mtb.reply(msg)
+		}
+		return mtb.parseCommandFEE()
+	case COMMANDS[PROOF]:
+		if !mtb.message.Chat.IsPrivate() {
+			return mtb.reply(msg)
+		}
+		// stat this command invocation
+		mtb.metricIncr("commands.*.counter", 1, label("command", "PROOF"))
+		return mtb.parseCommandPROOF()
+	case COMMANDS[CHECKPROOF]:
+		if !mtb.message.Chat.IsPrivate() {
+			return mtb.reply(msg)
+		}
+		// stat this command invocation
+		mtb.metricIncr("commands.*.counter", 1, label("command", "CHECKPROOF"))
+		return mtb.parseCommandCHECKPROOF()
+	case COMMANDS[RESERVES]:
+		if !mtb.message.Chat.IsPrivate() {
+			return mtb.reply(msg)
+		}
+		// stat this command invocation
+		mtb.metricIncr("commands.*.counter", 1, label("command", "RESERVES"))
+		return mtb.parseCommandRESERVES()
+	case COMMANDS[REJECT]:
+		// admins reject from ADMIN_CHAT_ID
+		// stat this command invocation
+		mtb.metricIncr("commands.*.counter", 1, label("command", "REJECT"))
+		return mtb.parseCommandREJECT()
+	case COMMANDS[ADMIN]:
+		// admins use this in the bot PM or ADMIN_CHAT_ID
+		// stat this command invocation
+		mtb.metricIncr("commands.*.counter", 1, label("command", "ADMIN"))
+		return mtb.parseCommandADMIN()
+	case COMMANDS[GROUPSETTINGS]:
+		// group admins use this in their group
+		// stat this command invocation
+		mtb.metricIncr("commands.*.counter", 1, label("command", "GROUPSETTINGS"))
+		return mtb.parseCommandGROUPSETTINGS()
 	}
 
 	return nil
@@ -450,24 +770,10 @@ func (mtb *MoneroTipBot) getUserAccount() (*Account, error) {
 		mtb.reply(msg)
 		return nil, err
 	}
-	// stat this command invocation
-	mtb.statsdGauge("user_accounts.counter", int64(len(accounts.SubaddressAccounts)))
-	// stat the total balance
-	mtb.statsdFGauge("total_balance.counter", wallet.XMRToFloat64(accounts.TotalBalance))
-	mtb.statsdFGauge("total_unlocked_balance.counter", wallet.XMRToFloat64(accounts.TotalUnlockedBalance))
+	// stat the accounts and the total balance
+	mtb.accountMetrics(accounts)
 
 	for _, address := range accounts.SubaddressAccounts {
-		// stat labels so we have them stored somewhere else than only in local files
-		split := strings.Split(address.Label, "@")
-		if len(split) == 2 {
-			userid, err := strconv.ParseInt(split[1], 10, 64)
-			if err == nil {
-				mtb.statsdGauge(fmt.Sprintf("account_labels_usernames.%s", split[0]), userid)
-				mtb.statsdGauge(fmt.Sprintf("account_labels.%d", userid), int64(address.AccountIndex))
-				mtb.statsdFGauge(fmt.Sprintf("account_balance_per_label.%d", userid), wallet.XMRToFloat64(address.Balance))
-			}
-		}
-
 		// IMPORTANT: we need to check for both, username AND userid. one after the other.
 		// a user could change his username. but userid is still the same!
 
@@ -546,7 +852,7 @@ func (mtb *MoneroTipBot) getUsername() string {
 
 func (mtb *MoneroTipBot) isReplyToMessage() bool {
 	if mtb.message.ReplyToMessage != nil {
-		mtb.statsdIncr("isreplytomessage.counter", 1)
+		mtb.metricIncr("isreplytomessage.counter", 1)
 		return true
 	}
 	return false
@@ -566,6 +872,15 @@ func (mtb *MoneroTipBot) isKnownUser() bool {
 	return false
 }
 
+func (mtb *MoneroTipBot) isAdmin() bool {
+	for _, id := range viper.GetIntSlice("ADMIN_USER_IDS") {
+		if id != 0 && id == mtb.from.ID {
+			return true
+		}
+	}
+	return false
+}
+
 func (mtb *MoneroTipBot) processGiveaway() error {
 	switch mtb.callback.Data {
 	case "giveaway_claim":
@@ -581,6 +896,25 @@ func (mtb *MoneroTipBot) processGiveaway() error {
 					return errors.New("Claimer is giver")
 				}
 
+				// the giver's limits apply, not the claimer's
+				err := mtb.checkLimits(int64(giveaway.From.From.ID), giveaway.Amount, false)
+				if err != nil {
+					mtb.bot.AnswerCallbackQuery(tgbotapi.CallbackConfig{
+						CallbackQueryID: mtb.callback.ID,
+						Text:            "This giveaway can't be claimed right now. The giver reached a spending limit.",
+					})
+					return err
+				}
+
+				err = mtb.checkTransfer(giveaway.Sender.AccountIndex)
+				if err != nil {
+					mtb.bot.AnswerCallbackQuery(tgbotapi.CallbackConfig{
+						CallbackQueryID: mtb.callback.ID,
+						Text:            err.Error(),
+					})
+					return err
+				}
+
 				claimeraccount, err := mtb.getUserAccount()
 				if err != nil {
 					return err
@@ -593,24 +927,36 @@ func (mtb *MoneroTipBot) processGiveaway() error {
 				})
 				// stat the transfer time
 				start := time.Now()
-				resp, err := mtb.walletrpc.Transfer(&wallet.RequestTransfer{
-					AccountIndex: giveaway.Sender.AccountIndex,
-					Destinations: destinations,
-				})
+				resp, err := mtb.transferFrom(giveaway.Sender.AccountIndex, destinations, tipPriority())
+				// the funds of the giver move. the claimer is the counterparty.
+				entry := mtb.newAuditEntry("giveaway_claim")
+				entry.UserID = int64(giveaway.From.From.ID)
+				entry.Username = giveaway.From.From.UserName
+				entry.AccountIndex = giveaway.Sender.AccountIndex
+				entry.Counterparty = claimer
+				entry.Amount = giveaway.Amount
+				entry.Details = fmt.Sprintf("claimed by user id %d, giveaway message %d", mtb.callback.From.ID, giveaway.Message.MessageID)
 				if err != nil {
+					mtb.audit(entry.fail(err))
 					edit := tgbotapi.NewEditMessageText(int64(mtb.callback.Message.Chat.ID), giveaway.Message.MessageID, fmt.Sprintf("User @%s is giving %f XMR away.\n\n...<b>%s</b>", giveaway.From.From.UserName, wallet.XMRToFloat64(giveaway.Amount), err))
 					edit.ParseMode = "HTML"
-					mtb.bot.Send(edit)
+					mtb.send(edit)
 					return err
 				}
-				mtb.statsdPrecisionTiming("transaction.time_to_complete", time.Since(start))
+				entry.Fee = resp.Fee
+				entry.TxHash = resp.TxHash
+				mtb.audit(entry)
+				mtb.metricTiming("transaction.time_to_complete", time.Since(start))
 				// stat the transaction count
-				mtb.statsdIncr("transactions.counter", 1)
+				mtb.metricIncr("transactions.counter", 1)
+				mtb.recordSpending(int64(giveaway.From.From.ID), giveaway.Amount, false)
+				mtb.recordGroupTip(mtb.callback.Message.Chat, giveaway.Amount)
 
 				mtb.giveaways = append(mtb.giveaways[:i], mtb.giveaways[i+1:]...)
 				mtb.saveGiveawayToFile()
 
 				tippermsg := mtb.newReplyMessage(false)
+				tippermsg.Receipt = true
 				// replace the chatID with the giver. else we notify the taker.
 				tippermsg.ChatID = int64(giveaway.From.From.ID)
 				tippermsg.Text = fmt.Sprintf("You successfully tipped user @%s.", strings.TrimPrefix(claimer, "@"))
@@ -618,25 +964,31 @@ func (mtb *MoneroTipBot) processGiveaway() error {
 
 				if giveaway.From.From.ID != 0 {
 					edit := tgbotapi.NewEditMessageText(int64(mtb.callback.Message.Chat.ID), giveaway.Message.MessageID, fmt.Sprintf("User @%s is giving %f XMR away.\n\n%f XMR given from @%s to @%s.", giveaway.From.From.UserName, wallet.XMRToFloat64(giveaway.Amount), wallet.XMRToFloat64(giveaway.Amount), giveaway.From.From.UserName, claimer))
-					mtb.bot.Send(edit)
+					mtb.sendReceipt(edit)
 
 					msg := mtb.newReplyMessage(false)
+					msg.Receipt = true
 					msg.Text = fmt.Sprintf("You have been tipped with %f XMR from user @%s", wallet.XMRToFloat64(giveaway.Amount), giveaway.From.From.UserName)
-					err := mtb.reply(msg)
-					if err != nil {
-						edit := tgbotapi.NewEditMessageText(int64(mtb.callback.Message.Chat.ID), giveaway.Message.MessageID, fmt.Sprintf("User @%s is giving %f XMR away.\n\n%f XMR given from @%s to @%s.\n\n@%s, you have been tipped.", giveaway.From.From.UserName, wallet.XMRToFloat64(resp.Amount), wallet.XMRToFloat64(resp.Amount), giveaway.From.From.UserName, claimer, claimer))
-						mtb.bot.Send(edit)
-						// send notification to giver here
-						return mtb.reply(tippermsg)
+					// whether the PM reached the claimer is known once the outbox delivered it. Done runs after this update is gone.
+					fallback := tgbotapi.NewEditMessageText(int64(mtb.callback.Message.Chat.ID), giveaway.Message.MessageID, fmt.Sprintf("User @%s is giving %f XMR away.\n\n%f XMR given from @%s to @%s.\n\n@%s, you have been tipped.", giveaway.From.From.UserName, wallet.XMRToFloat64(resp.Amount), wallet.XMRToFloat64(resp.Amount), giveaway.From.From.UserName, claimer, claimer))
+					tippermsg.log = mtb.logger()
+					msg.Done = func(err error) {
+						if err != nil {
+							mtb.sendReceipt(fallback)
+							// send notification to giver here
+							mtb.reply(tippermsg)
+							return
+						}
+						// send notification to giver here. with user has been notified
+						tippermsg.Text = fmt.Sprintf("%s\n\nUser has been notified.", tippermsg.Text)
+						mtb.reply(tippermsg)
 					}
-					// send notification to giver here. with user has been notified
-					tippermsg.Text = fmt.Sprintf("%s\n\nUser has been notified.", tippermsg.Text)
-					return mtb.reply(tippermsg)
+					return mtb.reply(msg)
 				}
 
 				edit := tgbotapi.NewEditMessageText(int64(mtb.callback.Message.Chat.ID), giveaway.Message.MessageID, fmt.Sprintf("User @%s is giving %f XMR away.\n\n%f XMR given from @%s to @%s.\n\n@%s, you have been tipped.\nPlease PM me (@%s) and click the 'Start' button to complete your account.", giveaway.From.From.UserName, wallet.XMRToFloat64(resp.Amount), wallet.XMRToFloat64(resp.Amount), giveaway.From.From.UserName, claimer, claimer, viper.GetString("BOT_NAME")))
 				edit.ParseMode = "HTML"
-				mtb.bot.Send(edit)
+				mtb.sendReceipt(edit)
 
 				// final send because giveaway.From.From.ID was 0.
 				return mtb.reply(tippermsg)
@@ -652,7 +1004,13 @@ func (mtb *MoneroTipBot) processGiveaway() error {
 				if giveaway.From.From.UserName == mtb.callback.From.UserName {
 					edit := tgbotapi.NewEditMessageText(int64(mtb.message.Chat.ID), giveaway.Message.MessageID, fmt.Sprintf("User @%s is giving %f XMR away\n\n...<b>Canceled!</b>", giveaway.From.From.UserName, wallet.XMRToFloat64(giveaway.Amount)))
 					edit.ParseMode = "HTML"
-					mtb.bot.Send(edit)
+					mtb.send(edit)
+
+					entry := mtb.newAuditEntry("giveaway_cancel")
+					entry.AccountIndex = giveaway.Sender.AccountIndex
+					entry.Amount = giveaway.Amount
+					entry.Details = fmt.Sprintf("giveaway message %d", giveaway.Message.MessageID)
+					mtb.audit(entry)
 
 					mtb.giveaways = append(mtb.giveaways[:i], mtb.giveaways[i+1:]...)
 					mtb.saveGiveawayToFile()
@@ -684,7 +1042,50 @@ func (mtb *MoneroTipBot) processQRCode() error {
 		for i, qrcode := range mtb.qrcodes {
 			if qrcode.Message.MessageID == mtb.message.MessageID {
 				if qrcode.From.From.UserName == mtb.callback.From.UserName {
+					err := mtb.checkWhitelist(qrcode.ParseURI.URI.Address)
+					if err != nil {
+						edit := tgbotapi.NewEditMessageText(int64(mtb.callback.Message.Chat.ID), mtb.callback.Message.MessageID, fmt.Sprintf("%s\n\n...<b>%s Aborted.</b>", mtb.callback.Message.Text, err))
+						edit.ParseMode = "HTML"
+						mtb.send(edit)
+						return err
+					}
+
+					if qrcode.Amount > wallet.Float64ToXMR(viper.GetFloat64("SECOND_FACTOR_SEND_THRESHOLD")) {
+						err = mtb.requireSecondFactor()
+						if err != nil {
+							return err
+						}
+					}
+
+					err = mtb.checkLimits(int64(mtb.from.ID), qrcode.Amount, false)
+					if err != nil {
+						edit := tgbotapi.NewEditMessageText(int64(mtb.callback.Message.Chat.ID), mtb.callback.Message.MessageID, fmt.Sprintf("%s\n\n...<b>%s Aborted.</b>", mtb.callback.Message.Text, err))
+						edit.ParseMode = "HTML"
+						mtb.send(edit)
+						return err
+					}
+
 					useraccount, err := mtb.getUserAccount()
+					if err != nil {
+						return err
+					}
+
+					err = mtb.checkTransfer(useraccount.AccountIndex)
+					if err != nil {
+						edit := tgbotapi.NewEditMessageText(int64(mtb.callback.Message.Chat.ID), mtb.callback.Message.MessageID, fmt.Sprintf("%s\n\n...<b>%s Aborted.</b>", mtb.callback.Message.Text, err))
+						edit.ParseMode = "HTML"
+						mtb.send(edit)
+						return err
+					}
+
+					if needsApproval(qrcode.Amount) {
+						edit := tgbotapi.NewEditMessageText(int64(mtb.callback.Message.Chat.ID), mtb.callback.Message.MessageID, fmt.Sprintf("%s\n\n...<b>Waiting for approval.</b>", mtb.callback.Message.Text))
+						edit.ParseMode = "HTML"
+						mtb.send(edit)
+
+						mtb.qrcodes = append(mtb.qrcodes[:i], mtb.qrcodes[i+1:]...)
+						return mtb.queueApproval(approvalKindSend, useraccount, qrcode.ParseURI.URI.Address, qrcode.Amount, wallet.PriorityDefault)
+					}
 
 					var destinations []*wallet.Destination
 
@@ -695,25 +1096,32 @@ func (mtb *MoneroTipBot) processQRCode() error {
 
 					// stat the transfer time
 					start := time.Now()
-					resp, err := mtb.walletrpc.Transfer(&wallet.RequestTransfer{
-						AccountIndex: useraccount.AccountIndex,
-						Destinations: destinations,
-					})
+					resp, err := mtb.transferFrom(useraccount.AccountIndex, destinations, wallet.PriorityDefault)
+					entry := mtb.newAuditEntry("qr_payment")
+					entry.AccountIndex = useraccount.AccountIndex
+					entry.Counterparty = qrcode.ParseURI.URI.Address
+					entry.Amount = qrcode.Amount
 					if err != nil {
+						mtb.audit(entry.fail(err))
 						edit := tgbotapi.NewEditMessageText(int64(mtb.callback.Message.Chat.ID), mtb.callback.Message.MessageID, fmt.Sprintf("%s\n\n...<b>%s! Aborted.</b>", mtb.callback.Message.Text, err))
 						edit.ParseMode = "HTML"
-						mtb.bot.Send(edit)
+						mtb.send(edit)
 						return err
 					}
-					mtb.statsdPrecisionTiming("transaction.time_to_complete", time.Since(start))
+					entry.Fee = resp.Fee
+					entry.TxHash = resp.TxHash
+					mtb.audit(entry)
+					mtb.metricTiming("transaction.time_to_complete", time.Since(start))
 					// stat the transaction count
-					mtb.statsdIncr("transactions.counter", 1)
+					mtb.metricIncr("transactions.counter", 1)
+					mtb.recordSpending(int64(mtb.from.ID), qrcode.Amount, false)
 
 					edit := tgbotapi.NewEditMessageText(int64(mtb.callback.Message.Chat.ID), mtb.callback.Message.MessageID, fmt.Sprintf("%s\n\n...<b>Transaction complete!</b>", mtb.callback.Message.Text))
 					edit.ParseMode = "HTML"
-					mtb.bot.Send(edit)
+					mtb.sendReceipt(edit)
 
 					msg.Format = false
+					msg.Receipt = true
 					msg.Text = fmt.Sprintf("Amount: %s\nFee: %s\nTxHash: <a href='%s%s'>%s", wallet.XMRToDecimal(resp.Amount), wallet.XMRToDecimal(resp.Fee), viper.GetString("blockexplorer_url"), resp.TxHash, resp.TxHash)
 					mtb.reply(msg)
 
@@ -733,7 +1141,7 @@ func (mtb *MoneroTipBot) processQRCode() error {
 				if qrcode.From.From.UserName == mtb.callback.From.UserName {
 					edit := tgbotapi.NewEditMessageText(int64(mtb.callback.Message.Chat.ID), mtb.callback.Message.MessageID, fmt.Sprintf("%s\n\n...<b>Canceled!</b>", mtb.callback.Message.Text))
 					edit.ParseMode = "HTML"
-					mtb.bot.Send(edit)
+					mtb.send(edit)
 
 					mtb.qrcodes = append(mtb.qrcodes[:i], mtb.qrcodes[i+1:]...)
 					return nil
@@ -746,6 +1154,8 @@ func (mtb *MoneroTipBot) processQRCode() error {
 }
 
 func (mtb *MoneroTipBot) saveGiveawayToFile() error {
+	mtb.metricGauge("giveaways.open", float64(len(mtb.giveaways)))
+
 	file, err := json.MarshalIndent(mtb.giveaways, "", " ")
 	if err != nil {
 		return err
@@ -831,8 +1241,8 @@ func (mtb *MoneroTipBot) parsePhoto() error {
 		msg := tgbotapi.NewMessage(mtb.message.Chat.ID, "")
 		msg.ReplyMarkup = markup
 		msg.Text = out
-		resp, _ := mtb.bot.Send(msg)
-		mtb.statsdIncr("qrcode_parsed.counter", 1)
+		resp, _ := mtb.sendWait(msg)
+		mtb.metricIncr("qrcode_parsed.counter", 1)
 
 		qrcode := &QRCode{
 			Message:  &resp,
@@ -854,11 +1264,11 @@ func (mtb *MoneroTipBot) parsePhoto() error {
 			mtb.reply(msg)
 			msg.Format = false
 			msg.Text = fmt.Sprintf("/send %s AMOUNTHERE", result)
-			mtb.statsdIncr("qrcode_parsed.counter", 1)
+			mtb.metricIncr("qrcode_parsed.counter", 1)
 			return mtb.reply(msg)
 		}
 		msg.Text = "Address is not valid. Aborted."
-		mtb.statsdIncr("qrcode_invalid.counter", 1)
+		mtb.metricIncr("qrcode_invalid.counter", 1)
 		return mtb.reply(msg)
 	}
 
@@ -870,6 +1280,10 @@ func (mtb *MoneroTipBot) listenRPC() {
 	for {
 		data, err := mtb.rpcchannel.RecvBytes(0)
 		if err != nil {
+			// the socket is closed on shutdown
+			if mtb.isStopping() {
+				return
+			}
 			data, err := prepareErrorNotification(notification, err)
 			if err != nil {
 				continue
@@ -893,7 +1307,7 @@ func (mtb *MoneroTipBot) listenRPC() {
 			ChatID: notification.UserID,
 			Text:   notification.Message,
 		}
-		err = mtb.reply(msg)
+		err = mtb.replyWait(msg)
 		if err != nil {
 			data, err := prepareErrorNotification(notification, err)
 			if err != nil {
@@ -930,44 +1344,3 @@ func prepareErrorNotification(notification *Notification, err error) ([]byte, er
 
 	return data, nil
 }
-
-func groupTrackerLogger(tracker map[int64]*tgbotapi.Chat) {
-	for {
-		file, err := os.OpenFile(viper.GetString("LOGFILE"), os.O_RDWR|os.O_CREATE, 0666)
-		if err != nil {
-			break
-		}
-		mutex.Lock()
-		for k, v := range tracker {
-			file.WriteString(fmt.Sprintf("Group ID: %d - Group Object: %#v\n", k, v))
-		}
-		mutex.Unlock()
-		file.Close()
-
-		time.Sleep(time.Minute * 60)
-	}
-}
-
-func (mtb *MoneroTipBot) statsdIncr(stat string, count int64, tags ...statsd.Tag) {
-	if viper.GetBool("USE_STATSD") {
-		mtb.statsdclient.Incr(stat, count, tags...)
-	}
-}
-
-func (mtb *MoneroTipBot) statsdGauge(stat string, value int64, tags ...statsd.Tag) {
-	if viper.GetBool("USE_STATSD") {
-		mtb.statsdclient.Gauge(stat, value, tags...)
-	}
-}
-
-func (mtb *MoneroTipBot) statsdFGauge(stat string, value float64, tags ...statsd.Tag) {
-	if viper.GetBool("USE_STATSD") {
-		mtb.statsdclient.FGauge(stat, value, tags...)
-	}
-}
-
-func (mtb *MoneroTipBot) statsdPrecisionTiming(stat string, delta time.Duration, tags ...statsd.Tag) {
-	if viper.GetBool("USE_STATSD") {
-		mtb.statsdclient.PrecisionTiming(stat, delta, tags...)
-	}
-}
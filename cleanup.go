@@ -0,0 +1,139 @@
+package monerotipbot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+var cleanupmutex sync.Mutex
+
+// loadDeletions reads the pending deletions from CLEANUP_FILE, so they survive a restart. A missing file means none.
+func loadDeletions() ([]*Deletion, error) {
+	var deletions []*Deletion
+
+	file, err := ioutil.ReadFile(viper.GetString("CLEANUP_FILE"))
+	if err != nil {
+		return deletions, nil
+	}
+
+	err = json.Unmarshal(file, &deletions)
+	if err != nil {
+		return nil, err
+	}
+
+	return deletions, nil
+}
+
+// saveDeletionsToFile must be called with cleanupmutex held
+func (mtb *MoneroTipBot) saveDeletionsToFile() error {
+	file, err := json.MarshalIndent(mtb.deletions, "", " ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(viper.GetString("CLEANUP_FILE"), file, 0600)
+}
+
+// isCleanupChat reports whether messages in chat are cleaned up. The admin chat and the reserves channel are kept.
+func isCleanupChat(chat *tgbotapi.Chat) bool {
+	if chat == nil || (!chat.IsGroup() && !chat.IsSuperGroup()) {
+		return false
+	}
+	return chat.ID != viper.GetInt64("ADMIN_CHAT_ID") && chat.ID != viper.GetInt64("RESERVES_CHANNEL_ID")
+}
+
+// scheduleDeletion deletes the message messageid in chatid after delay
+func (mtb *MoneroTipBot) scheduleDeletion(chatid int64, messageid int, delay time.Duration) {
+	cleanupmutex.Lock()
+	defer cleanupmutex.Unlock()
+
+	mtb.deletions = append(mtb.deletions, &Deletion{
+		ChatID:    chatid,
+		MessageID: messageid,
+		DeleteAt:  time.Now().Add(delay),
+	})
+	err := mtb.saveDeletionsToFile()
+	if err != nil {
+		mtb.logger().WithError(err).Error("Error while saving deletions")
+	}
+}
+
+// cleanupReply schedules the deletion of a reply of the bot in a group after CLEANUP_MESSAGE_DELAY seconds.
+// Announcements (msg.Keep) stay.
+func (mtb *MoneroTipBot) cleanupReply(msg *Message, resp tgbotapi.Message) {
+	delay := viper.GetInt("CLEANUP_MESSAGE_DELAY")
+	if delay <= 0 || msg.Keep || !isCleanupChat(resp.Chat) {
+		return
+	}
+	mtb.scheduleDeletion(resp.Chat.ID, resp.MessageID, time.Duration(delay)*time.Second)
+}
+
+// cleanupCommand schedules the deletion of the command message of the user in a group after CLEANUP_COMMAND_DELAY seconds.
+// The bot needs the right to delete messages of others for this. Without it the deletion fails and is dropped.
+func (mtb *MoneroTipBot) cleanupCommand() {
+	delay := viper.GetInt("CLEANUP_COMMAND_DELAY")
+	if delay <= 0 || !isCleanupChat(mtb.message.Chat) {
+		return
+	}
+	// commands addressed to other bots in the group are none of our business
+	for _, command := range COMMANDS {
+		if mtb.message.Command() == command {
+			mtb.scheduleDeletion(mtb.message.Chat.ID, mtb.message.MessageID, time.Duration(delay)*time.Second)
+			return
+		}
+	}
+}
+
+// cleanupScheduler deletes the messages that are due every few seconds
+func (mtb *MoneroTipBot) cleanupScheduler() {
+	for {
+		time.Sleep(time.Second * 5)
+
+		cleanupmutex.Lock()
+		var due []*Deletion
+		now := time.Now()
+		for _, deletion := range mtb.deletions {
+			if now.After(deletion.DeleteAt) {
+				due = append(due, deletion)
+			}
+		}
+		cleanupmutex.Unlock()
+
+		if len(due) == 0 {
+			continue
+		}
+
+		done := make(map[*Deletion]bool)
+		for _, deletion := range due {
+			_, err := mtb.bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: deletion.ChatID, MessageID: deletion.MessageID})
+			if err != nil {
+				// missing rights, already deleted by someone else or older than 48 hours. there is no point in retrying.
+				mtb.metricIncr("cleanup.failures.counter", 1)
+				jobLogger("cleanup").WithError(err).WithFields(logrus.Fields{"chat_id": deletion.ChatID, "message_id": deletion.MessageID}).Debug("Error while deleting message")
+			} else {
+				mtb.metricIncr("cleanup.deleted.counter", 1)
+			}
+			done[deletion] = true
+		}
+
+		cleanupmutex.Lock()
+		var deletions []*Deletion
+		for _, deletion := range mtb.deletions {
+			if !done[deletion] {
+				deletions = append(deletions, deletion)
+			}
+		}
+		mtb.deletions = deletions
+		err := mtb.saveDeletionsToFile()
+		if err != nil {
+			jobLogger("cleanup").WithError(err).Error("Error while saving deletions")
+		}
+		cleanupmutex.Unlock()
+	}
+}
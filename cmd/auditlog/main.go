@@ -0,0 +1,98 @@
+// AuditLog checks and exports the audit log of the bot without the bot or the wallet running,
+// e.g. on a backup copy on another machine.
+
+// verify walks the hash chain like /admin audit verify and prints the hash of the last entry. Entries cut off at
+// the end can't be detected from the file alone, so compare it with a hash you kept somewhere else.
+// export prints the entries of a user and/or a time range as JSONL like /admin audit export.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	monerotipbot "github.com/omani/telegram-monerotipbot"
+)
+
+var (
+	configpath string
+	logfile    string
+	userid     int64
+	from       string
+	to         string
+)
+
+func main() {
+	flag.StringVar(&configpath, "c", "", "")
+	flag.StringVar(&logfile, "file", "", "Use FILE instead of AUDIT_LOG_FILE, e.g. a backup copy.")
+	flag.Int64Var(&userid, "user", 0, "export: only the entries of this telegram user id.")
+	flag.StringVar(&from, "from", "", "export: only the entries from this UTC day on (YYYY-MM-DD).")
+	flag.StringVar(&to, "to", "", "export: only the entries up to this UTC day, inclusive (YYYY-MM-DD).")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] verify|export\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	if !flag.Parsed() {
+		log.Fatal("Couldn't parse cli arguments. Aborted")
+	}
+
+	if configpath == "" {
+		configpath = filepath.Join(os.Getenv("HOME"), "settings.toml")
+	}
+
+	viper.SetConfigType("yaml")
+	viper.SetConfigName(strings.TrimSuffix(path.Base(configpath), path.Ext(configpath)))
+	viper.AddConfigPath(path.Dir(configpath))
+	err := viper.ReadInConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(logfile) > 0 {
+		viper.Set("AUDIT_LOG_FILE", logfile)
+	}
+
+	switch flag.Arg(0) {
+	case "verify":
+		count, last, err := monerotipbot.VerifyAuditLog()
+		if err != nil {
+			log.Fatalf("Audit log is NOT intact: %s", err)
+		}
+		fmt.Printf("Audit log is intact. %d entries verified.\nLast hash: %s\n", count, last)
+	case "export":
+		start := time.Time{}
+		end := time.Now().UTC().Add(time.Hour)
+		if len(from) > 0 {
+			start, err = time.Parse("2006-01-02", from)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if len(to) > 0 {
+			day, err := time.Parse("2006-01-02", to)
+			if err != nil {
+				log.Fatal(err)
+			}
+			end = day.AddDate(0, 0, 1)
+		}
+
+		data, count, err := monerotipbot.ExportAuditLog(userid, start, end)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(data)
+		log.Printf("%d audit log entries exported.", count)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
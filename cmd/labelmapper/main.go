@@ -3,14 +3,23 @@
 // That implies that we will lose all labels whenever the wallet crashes or gets lost for whatever reasons.
 // The LabelMapper helps us to make a "backup" of all labels within the wallet so that we are able to relabel a new wallet, should we ever have to do it.
 
-// Run this scrript as a cron job and backup the produced json file to somewhere secure (ideally not on the same server where this wallet is running)
+// The labels contain the username and user ID of every user, so the backup is encrypted with AES-256-GCM
+// and the key in LABELMAP_KEY_FILE. Create a key with -genkey and keep a copy of it somewhere safe.
+
+// Run this scrript as a cron job and backup the produced file to somewhere secure (ideally not on the same server where this wallet is running)
 
 package main
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
@@ -22,10 +31,18 @@ import (
 	"github.com/spf13/viper"
 )
 
-var configpath string
+var (
+	configpath string
+	genkey     bool
+	decrypt    string
+	plain      bool
+)
 
 func main() {
 	flag.StringVar(&configpath, "c", "", "")
+	flag.BoolVar(&genkey, "genkey", false, "Create a new key in LABELMAP_KEY_FILE.")
+	flag.StringVar(&decrypt, "decrypt", "", "Decrypt FILE and print the labels.")
+	flag.BoolVar(&plain, "plain", false, "Write the labels unencrypted to labelmap.json.")
 
 	flag.Parse()
 	if !flag.Parsed() {
@@ -48,6 +65,27 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if genkey {
+		err := createKey(viper.GetString("LABELMAP_KEY_FILE"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(decrypt) > 0 {
+		data, err := os.ReadFile(decrypt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		file, err := open(data)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(file)
+		return
+	}
+
 	walletrpc := wallet.New(wallet.Config{
 		Address: viper.GetString("monero_rpc_daemon_url"),
 	})
@@ -58,5 +96,85 @@ func main() {
 	}
 	file, _ := json.MarshalIndent(accounts, "", " ")
 
-	_ = os.WriteFile("labelmap.json", file, 0644)
+	if plain {
+		err = os.WriteFile("labelmap.json", file, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	data, err := seal(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.WriteFile("labelmap.json.enc", data, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func createKey(keyfile string) error {
+	if len(keyfile) == 0 {
+		return errors.New("LABELMAP_KEY_FILE is not set")
+	}
+	if _, err := os.Stat(keyfile); err == nil {
+		return fmt.Errorf("%s already exists. Not overwriting it.", keyfile)
+	}
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(keyfile, []byte(hex.EncodeToString(key)+"\n"), 0600)
+}
+
+func newGCM() (cipher.AEAD, error) {
+	keyfile := viper.GetString("LABELMAP_KEY_FILE")
+	if len(keyfile) == 0 {
+		return nil, errors.New("LABELMAP_KEY_FILE is not set. Create a key with -genkey or write an unencrypted file with -plain.")
+	}
+	data, err := os.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s must contain a 32 bytes key (64 hex characters)", keyfile)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext. the random nonce is prepended to the ciphertext.
+func seal(plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(data []byte) ([]byte, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("file too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
 }
@@ -4,6 +4,10 @@ import (
 	_ "image/jpeg"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
 
 	monerotipbot "github.com/omani/telegram-monerotipbot"
 )
@@ -24,8 +28,40 @@ func main() {
 		log.Fatal(err)
 	}
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
 	// start monerotipbot
-	bot.Run()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- bot.Run()
+	}()
+
+	status := 0
+	select {
+	case sig := <-signals:
+		logrus.WithField("signal", sig.String()).Info("Shutting down")
+	case err := <-stopped:
+		if err != nil {
+			logrus.WithError(err).Error("Error while running the bot")
+			status = 1
+		}
+	}
+
+	// a second signal doesn't wait for the shutdown
+	go func() {
+		sig := <-signals
+		logrus.WithField("signal", sig.String()).Warn("Received signal again. Exiting now.")
+		os.Exit(1)
+	}()
+
+	err = bot.Shutdown()
+	if err != nil {
+		logrus.WithError(err).Error("Error while shutting down")
+		status = 1
+	}
+	logrus.WithField("status", status).Info("Shut down")
+	os.Exit(status)
 }
 
 func catchpanics() {
@@ -0,0 +1,430 @@
+package monerotipbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omani/go-monero-rpc-client/wallet"
+	"github.com/spf13/viper"
+)
+
+var coldmutex sync.Mutex
+
+// loadColdAllocations reads the pooled balances of all accounts from COLD_ALLOCATIONS_FILE. A missing file means nothing is pooled.
+func loadColdAllocations() (map[uint64]uint64, error) {
+	allocations := make(map[uint64]uint64)
+
+	file, err := ioutil.ReadFile(viper.GetString("COLD_ALLOCATIONS_FILE"))
+	if err != nil {
+		return allocations, nil
+	}
+
+	var entries []*ColdAllocation
+	err = json.Unmarshal(file, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		allocations[entry.AccountIndex] = entry.Amount
+	}
+
+	return allocations, nil
+}
+
+// saveColdAllocationsToFile must be called with coldmutex held
+func (mtb *MoneroTipBot) saveColdAllocationsToFile() error {
+	var entries []*ColdAllocation
+	for index, amount := range mtb.coldallocations {
+		entries = append(entries, &ColdAllocation{AccountIndex: index, Amount: amount})
+	}
+
+	file, err := json.MarshalIndent(entries, "", " ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(viper.GetString("COLD_ALLOCATIONS_FILE"), file, 0644)
+}
+
+// coldBalance returns the pooled balance of an account: the part of its balance held by the primary account or in cold storage
+func (mtb *MoneroTipBot) coldBalance(accountindex uint64) uint64 {
+	coldmutex.Lock()
+	defer coldmutex.Unlock()
+	return mtb.coldallocations[accountindex]
+}
+
+// totalColdBalance returns the sum of all pooled balances
+func (mtb *MoneroTipBot) totalColdBalance() uint64 {
+	coldmutex.Lock()
+	defer coldmutex.Unlock()
+
+	var total uint64
+	for _, amount := range mtb.coldallocations {
+		total += amount
+	}
+	return total
+}
+
+// creditPool audits entry and credits its amount and fee to the pooled balance of its account. The fees of moving
+// funds into the pool are on the operator.
+func (mtb *MoneroTipBot) creditPool(entry *AuditEntry) error {
+	// the ledger and the audit log change together, see reconcilePool
+	coldmutex.Lock()
+	defer coldmutex.Unlock()
+
+	mtb.audit(entry)
+	mtb.coldallocations[entry.AccountIndex] += entry.Amount + entry.Fee
+	return mtb.saveColdAllocationsToFile()
+}
+
+// debitPool audits entry and debits its amount from the pooled balance of its account. The fees of paying from the
+// pool are on the operator, like the fees of moving funds into it.
+func (mtb *MoneroTipBot) debitPool(entry *AuditEntry) error {
+	coldmutex.Lock()
+	defer coldmutex.Unlock()
+
+	mtb.audit(entry)
+	if entry.Amount >= mtb.coldallocations[entry.AccountIndex] {
+		delete(mtb.coldallocations, entry.AccountIndex)
+	} else {
+		mtb.coldallocations[entry.AccountIndex] -= entry.Amount
+	}
+	return mtb.saveColdAllocationsToFile()
+}
+
+// poolAccount sweeps the unlocked balance of accountindex to the primary account at address and credits the moved
+// amount plus fee to the pooled balance of the account. The whole account is swept, so no change output locks the
+// rest of its balance.
+func (mtb *MoneroTipBot) poolAccount(walletrpc *resilientWallet, accountindex uint64, address string) (uint64, error) {
+	resp, err := walletrpc.SweepAll(&wallet.RequestSweepAll{
+		AccountIndex:      accountindex,
+		Address:           address,
+		SubaddrIndicesAll: true,
+		Priority:          tipPriority(),
+	})
+	entry := &AuditEntry{
+		Action:       "pool_credit",
+		AccountIndex: accountindex,
+		Counterparty: address,
+		Outcome:      auditOutcomeOK,
+	}
+	if err != nil {
+		mtb.audit(entry.fail(err))
+		return 0, err
+	}
+	for i := range resp.TxHashList {
+		entry.Amount += resp.AmountList[i]
+		entry.Fee += resp.FeeList[i]
+	}
+	entry.TxHash = strings.Join(resp.TxHashList, ",")
+
+	err = mtb.creditPool(entry)
+	mtb.metricIncr("pool_consolidations.counter", 1)
+	return entry.Amount, err
+}
+
+// consolidateToPool moves the unlocked balances of the user accounts with the largest unlocked balances to the
+// primary account, until needed is covered. Only with POOL_CONSOLIDATION on.
+func (mtb *MoneroTipBot) consolidateToPool(walletrpc *resilientWallet, primary *Account, accounts []*Account, needed uint64) (uint64, error) {
+	feereserve := wallet.Float64ToXMR(viper.GetFloat64("COLD_FEE_RESERVE"))
+
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].UnlockedBalance > accounts[j].UnlockedBalance
+	})
+
+	var consolidated uint64
+	for _, account := range accounts {
+		if consolidated >= needed {
+			break
+		}
+		if account.AccountIndex == 0 || !isUserAccountLabel(account.Label) || account.UnlockedBalance <= feereserve {
+			continue
+		}
+		// frozen accounts stay where they are
+		if mtb.checkTransfer(account.AccountIndex) != nil {
+			continue
+		}
+
+		amount, err := mtb.poolAccount(walletrpc, account.AccountIndex, primary.BaseAddress)
+		consolidated += amount
+		if err != nil {
+			return consolidated, err
+		}
+	}
+
+	return consolidated, nil
+}
+
+// sweepToCold moves up to surplus from the unlocked balance of the primary account to COLD_WALLET_ADDRESS.
+// Only the pool is swept. The pooled balances of the users don't change, no matter where the pool keeps its coins.
+func (mtb *MoneroTipBot) sweepToCold(walletrpc *resilientWallet, primary *Account, surplus uint64) (uint64, error) {
+	feereserve := wallet.Float64ToXMR(viper.GetFloat64("COLD_FEE_RESERVE"))
+	if primary.UnlockedBalance <= feereserve {
+		return 0, nil
+	}
+	amount := primary.UnlockedBalance - feereserve
+	if amount > surplus {
+		amount = surplus
+	}
+
+	resp, err := walletrpc.Transfer(&wallet.RequestTransfer{
+		AccountIndex: primary.AccountIndex,
+		Destinations: []*wallet.Destination{{Amount: amount, Address: viper.GetString("COLD_WALLET_ADDRESS")}},
+		Priority:     tipPriority(),
+	})
+	entry := &AuditEntry{
+		Action:       "cold_sweep",
+		AccountIndex: primary.AccountIndex,
+		Counterparty: viper.GetString("COLD_WALLET_ADDRESS"),
+		Amount:       amount,
+		Outcome:      auditOutcomeOK,
+	}
+	if err != nil {
+		mtb.audit(entry.fail(err))
+		return 0, err
+	}
+	entry.Fee = resp.Fee
+	entry.TxHash = resp.TxHash
+	mtb.audit(entry)
+	mtb.metricIncr("cold_sweeps.counter", 1)
+
+	return resp.Amount, nil
+}
+
+// transferFrom pays destinations for the user of accountindex. If the account can't cover them, the primary account
+// pays and the pooled balance of the user is debited with the amount. When neither covers them alone, the unlocked
+// balance of the account joins the pool first.
+// Only the dispatcher pays from pooled balances, so coldmutex isn't held across the wallet calls: the scheduler
+// may only add to a pooled balance in between.
+func (mtb *MoneroTipBot) transferFrom(accountindex uint64, destinations []*wallet.Destination, priority wallet.Priority) (*wallet.ResponseTransfer, error) {
+	request := &wallet.RequestTransfer{
+		AccountIndex: accountindex,
+		Destinations: destinations,
+		Priority:     priority,
+	}
+
+	pooled := mtb.coldBalance(accountindex)
+	if pooled == 0 {
+		return mtb.walletrpc.Transfer(request)
+	}
+
+	var amount uint64
+	for _, destination := range destinations {
+		amount += destination.Amount
+	}
+	balance, err := mtb.walletrpc.GetBalance(&wallet.RequestGetBalance{AccountIndex: accountindex})
+	if err != nil {
+		return nil, err
+	}
+	feereserve := wallet.Float64ToXMR(viper.GetFloat64("COLD_FEE_RESERVE"))
+	if balance.UnlockedBalance >= amount+feereserve {
+		return mtb.walletrpc.Transfer(request)
+	}
+	if pooled+balance.UnlockedBalance < amount {
+		return nil, fmt.Errorf("Not enough unlocked money. You can send up to %f XMR at the moment", wallet.XMRToFloat64(pooled+balance.UnlockedBalance))
+	}
+
+	if pooled < amount {
+		primary, err := mtb.walletrpc.GetAddress(&wallet.RequestGetAddress{AccountIndex: 0})
+		if err != nil {
+			return nil, err
+		}
+		_, err = mtb.poolAccount(mtb.walletrpc, accountindex, primary.Address)
+		if err != nil {
+			return nil, err
+		}
+		pooled = mtb.coldBalance(accountindex)
+		if pooled < amount {
+			return nil, fmt.Errorf("Not enough unlocked money. You can send up to %f XMR at the moment", wallet.XMRToFloat64(pooled))
+		}
+	}
+
+	request.AccountIndex = 0
+	resp, err := mtb.walletrpc.Transfer(request)
+	entry := &AuditEntry{
+		Action:       "pool_debit",
+		AccountIndex: accountindex,
+		Amount:       amount,
+		Outcome:      auditOutcomeOK,
+		Details:      "paid by the primary account",
+	}
+	if err != nil {
+		mtb.audit(entry.fail(err))
+		return nil, err
+	}
+	entry.Fee = resp.Fee
+	entry.TxHash = resp.TxHash
+
+	// the funds are gone already. a failed save must not turn this into an error for the user.
+	err = mtb.debitPool(entry)
+	if err != nil {
+		mtb.logger().WithError(err).WithField("account_index", accountindex).Error("Error while saving the pooled balances")
+	}
+	mtb.metricIncr("pool_payments.counter", 1)
+	return resp, nil
+}
+
+// withdrawAll sends everything of the user of accountindex to address: the unlocked balance of the account and
+// the pooled balance, which the primary account pays. On error the returned withdrawal holds what was sent anyway.
+func (mtb *MoneroTipBot) withdrawAll(accountindex uint64, address string, priority wallet.Priority) (*Withdrawal, error) {
+	withdrawal := &Withdrawal{}
+
+	pooled := mtb.coldBalance(accountindex)
+	balance, err := mtb.walletrpc.GetBalance(&wallet.RequestGetBalance{AccountIndex: accountindex})
+	if err != nil {
+		return withdrawal, err
+	}
+
+	// without a pooled balance the wallet tells the user there is nothing to withdraw
+	if balance.UnlockedBalance > 0 || pooled == 0 {
+		resp, err := mtb.walletrpc.SweepAll(&wallet.RequestSweepAll{
+			AccountIndex:      accountindex,
+			Address:           address,
+			SubaddrIndicesAll: true,
+			Priority:          priority,
+		})
+		if err != nil {
+			return withdrawal, err
+		}
+		for i := range resp.TxHashList {
+			withdrawal.Amount += resp.AmountList[i]
+			withdrawal.Fee += resp.FeeList[i]
+		}
+		withdrawal.TxHashes = append(withdrawal.TxHashes, resp.TxHashList...)
+	}
+	if pooled == 0 {
+		return withdrawal, nil
+	}
+
+	resp, err := mtb.walletrpc.Transfer(&wallet.RequestTransfer{
+		AccountIndex: 0,
+		Destinations: []*wallet.Destination{{Amount: pooled, Address: address}},
+		Priority:     priority,
+	})
+	entry := &AuditEntry{
+		Action:       "pool_debit",
+		AccountIndex: accountindex,
+		Counterparty: address,
+		Amount:       pooled,
+		Outcome:      auditOutcomeOK,
+		Details:      "withdrawal paid by the primary account",
+	}
+	if err != nil {
+		mtb.audit(entry.fail(err))
+		return withdrawal, err
+	}
+	entry.Fee = resp.Fee
+	entry.TxHash = resp.TxHash
+	withdrawal.Amount += resp.Amount
+	withdrawal.Fee += resp.Fee
+	withdrawal.TxHashes = append(withdrawal.TxHashes, resp.TxHash)
+
+	err = mtb.debitPool(entry)
+	if err != nil {
+		mtb.logger().WithError(err).WithField("account_index", accountindex).Error("Error while saving the pooled balances")
+	}
+	mtb.metricIncr("pool_payments.counter", 1)
+	return withdrawal, nil
+}
+
+func (w *Withdrawal) String() string {
+	var hashes []string
+	for _, hash := range w.TxHashes {
+		hashes = append(hashes, fmt.Sprintf("TxHash: <a href='%s%s'>%s</a>", viper.GetString("blockexplorer_url"), hash, hash))
+	}
+	return fmt.Sprintf("Amount: %f\nFee: %f\n%s", wallet.XMRToFloat64(w.Amount), wallet.XMRToFloat64(w.Fee), strings.Join(hashes, "\n"))
+}
+
+// balanceHotWallet keeps the hot wallet below HOT_WALLET_CEILING: the surplus is swept from the primary account to
+// cold storage. With POOL_CONSOLIDATION, user accounts are consolidated into the primary account when it doesn't hold enough.
+// The admins get a refill request when the hot wallet drops below HOT_WALLET_FLOOR.
+func (mtb *MoneroTipBot) balanceHotWallet() error {
+	walletrpc := mtb.jobWallet("coldwallet")
+	resp, err := walletrpc.GetAccounts(&wallet.RequestGetAccounts{})
+	if err != nil {
+		return err
+	}
+
+	var accounts []*Account
+	primary := &Account{}
+	for _, address := range resp.SubaddressAccounts {
+		account := &Account{
+			AccountIndex:    address.AccountIndex,
+			Balance:         address.Balance,
+			BaseAddress:     address.BaseAddress,
+			Label:           address.Label,
+			Tag:             address.Tag,
+			UnlockedBalance: address.UnlockedBalance,
+		}
+		if account.AccountIndex == 0 {
+			primary = account
+		}
+		accounts = append(accounts, account)
+	}
+
+	ceiling := wallet.Float64ToXMR(viper.GetFloat64("HOT_WALLET_CEILING"))
+	if ceiling > 0 && resp.TotalUnlockedBalance > ceiling {
+		surplus := resp.TotalUnlockedBalance - ceiling
+		swept, err := mtb.sweepToCold(walletrpc, primary, surplus)
+		if swept > 0 {
+			mtb.notifyAdmins("coldwallet", fmt.Sprintf("Swept %f XMR from the primary account to cold storage.\n\nPooled balances of the users: %f XMR", wallet.XMRToFloat64(swept), wallet.XMRToFloat64(mtb.totalColdBalance())))
+		}
+		if err != nil || swept >= surplus {
+			return err
+		}
+		if !viper.GetBool("POOL_CONSOLIDATION") {
+			return nil
+		}
+		// the consolidated funds are locked for a while. a later round sweeps them.
+		consolidated, err := mtb.consolidateToPool(walletrpc, primary, accounts, surplus-swept)
+		if consolidated > 0 {
+			jobLogger("coldwallet").WithField("amount", wallet.XMRToFloat64(consolidated)).Info("Consolidated user accounts into the primary account")
+		}
+		return err
+	}
+
+	floor := wallet.Float64ToXMR(viper.GetFloat64("HOT_WALLET_FLOOR"))
+	if floor == 0 || mtb.totalColdBalance() == 0 || resp.TotalUnlockedBalance >= floor {
+		mtb.refillrequested = false
+		return nil
+	}
+	// ask only once until the hot wallet recovered
+	if mtb.refillrequested {
+		return nil
+	}
+	mtb.refillrequested = true
+
+	address, err := walletrpc.GetAddress(&wallet.RequestGetAddress{AccountIndex: 0})
+	if err != nil {
+		return err
+	}
+	return mtb.notifyAdmins("coldwallet", fmt.Sprintf("Hot wallet below floor: %f XMR unlocked (floor %f XMR).\n\nPlease refill from cold storage (%f XMR pooled) to the primary account:\n%s", wallet.XMRToFloat64(resp.TotalUnlockedBalance), wallet.XMRToFloat64(floor), wallet.XMRToFloat64(mtb.totalColdBalance()), address.Address))
+}
+
+// coldWalletScheduler runs balanceHotWallet every HOT_WALLET_CHECK_INTERVAL minutes, if COLD_WALLET_ADDRESS is set
+func (mtb *MoneroTipBot) coldWalletScheduler() {
+	for {
+		interval := time.Duration(viper.GetInt("HOT_WALLET_CHECK_INTERVAL")) * time.Minute
+		// no transfers during maintenance or while the wallet is unhealthy
+		if len(viper.GetString("COLD_WALLET_ADDRESS")) == 0 || interval == 0 || mtb.isMaintenance() || !mtb.isHealthy() {
+			time.Sleep(time.Minute * 60)
+			continue
+		}
+
+		if !mtb.beginWork() {
+			return
+		}
+		err := mtb.balanceHotWallet()
+		mtb.inflight.Done()
+		if err != nil {
+			jobLogger("coldwallet").WithError(err).Error("Error while balancing the hot wallet")
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -52,6 +52,30 @@ func (mtb *MoneroTipBot) parseCommandHELP() error {
 		case COMMANDS[GENERATEQR]:
 			msg.Text = viper.GetString("help_message_GENERATEQR")
 			return mtb.reply(msg)
+		case COMMANDS[WHITELIST]:
+			msg.Text = viper.GetString("help_message_WHITELIST")
+			return mtb.reply(msg)
+		case COMMANDS[SECURITY]:
+			msg.Text = viper.GetString("help_message_SECURITY")
+			return mtb.reply(msg)
+		case COMMANDS[LIMITS]:
+			msg.Text = viper.GetString("help_message_LIMITS")
+			return mtb.reply(msg)
+		case COMMANDS[FEE]:
+			msg.Text = viper.GetString("help_message_FEE")
+			return mtb.reply(msg)
+		case COMMANDS[PROOF]:
+			msg.Text = viper.GetString("help_message_PROOF")
+			return mtb.reply(msg)
+		case COMMANDS[CHECKPROOF]:
+			msg.Text = viper.GetString("help_message_CHECKPROOF")
+			return mtb.reply(msg)
+		case COMMANDS[RESERVES]:
+			msg.Text = viper.GetString("help_message_RESERVES")
+			return mtb.reply(msg)
+		case COMMANDS[GROUPSETTINGS]:
+			msg.Text = viper.GetString("help_message_GROUPSETTINGS")
+			return mtb.reply(msg)
 		default:
 			msg.Text = "Command not found."
 			return mtb.reply(msg)
@@ -64,7 +88,7 @@ func (mtb *MoneroTipBot) parseCommandTIP() error {
 	msg := mtb.newReplyMessage(true)
 
 	if len(mtb.message.CommandArguments()) == 0 {
-		msg.Text = fmt.Sprintf("Please specify username and amount to tip (with optional message): /tip username %f yourmessage goes here", viper.GetFloat64("MIN_TIP_AMOUNT"))
+		msg.Text = fmt.Sprintf("Please specify username and amount to tip (with optional message): /tip username %f yourmessage goes here", mtb.minTipAmount())
 		return mtb.reply(msg)
 	}
 	var split []string
@@ -129,11 +153,11 @@ func (mtb *MoneroTipBot) parseCommandTIP() error {
 		msg.Text = "Could not parse amount."
 		return mtb.reply(msg)
 	}
-	if parseamount < viper.GetFloat64("MIN_TIP_AMOUNT") {
+	if parseamount < mtb.minTipAmount() {
 		if !mtb.message.Chat.IsPrivate() {
 			msg.ChatID = mtb.message.Chat.ID
 		}
-		msg.Text = fmt.Sprintf("Minimum amount for a tip is %f XMR", viper.GetFloat64("MIN_TIP_AMOUNT"))
+		msg.Text = fmt.Sprintf("Minimum amount for a tip is %f XMR", mtb.minTipAmount())
 		return mtb.reply(msg)
 	}
 	amount := wallet.Float64ToXMR(parseamount)
@@ -151,6 +175,13 @@ func (mtb *MoneroTipBot) parseCommandTIP() error {
 		return mtb.reply(msg)
 	}
 
+	senderid := int64(mtb.from.ID)
+	err = mtb.checkLimits(senderid, amount, true)
+	if err != nil {
+		msg.Text = err.Error()
+		return mtb.reply(msg)
+	}
+
 	useraccount, err := mtb.getUserAccount()
 	if err != nil {
 		return err
@@ -207,22 +238,30 @@ func (mtb *MoneroTipBot) parseCommandTIP() error {
 
 	// stat the transfer time
 	start := time.Now()
-	resp, err := mtb.walletrpc.Transfer(&wallet.RequestTransfer{
-		AccountIndex: useraccount.AccountIndex,
-		Destinations: destinations,
-	})
+	resp, err := mtb.transferFrom(useraccount.AccountIndex, destinations, tipPriority())
+	entry := mtb.newAuditEntry("tip")
+	entry.AccountIndex = useraccount.AccountIndex
+	entry.Counterparty = recipientaccount.Label
+	entry.Amount = amount
 	if err != nil {
+		mtb.audit(entry.fail(err))
 		if !mtb.message.Chat.IsPrivate() {
 			msg.ChatID = mtb.message.Chat.ID
 		}
 		msg.Text = fmt.Sprintf("Tip Error: %s", err)
 		return mtb.reply(msg)
 	}
-	mtb.statsdPrecisionTiming("transaction.time_to_complete", time.Since(start))
+	mtb.metricTiming("transaction.time_to_complete", time.Since(start))
 	// stat the transaction count
-	mtb.statsdIncr("transactions.counter", 1)
+	mtb.metricIncr("transactions.counter", 1)
+	entry.Fee = resp.Fee
+	entry.TxHash = resp.TxHash
+	mtb.audit(entry)
+	mtb.recordSpending(senderid, amount, true)
+	mtb.recordGroupTip(mtb.message.Chat, amount)
 
 	tippermsg := mtb.newReplyMessage(false)
+	tippermsg.Receipt = true
 	tippermsg.Text = fmt.Sprintf("You successfully tipped user @%s.", strings.TrimPrefix(casesensitiveusername, "@"))
 	tippermsg.Text = fmt.Sprintf("%s\n\nAmount: %f\nFee: %f\nTxHash: <a href='%s%s'>%s</a>", tippermsg.Text, wallet.XMRToFloat64(amount), wallet.XMRToFloat64(resp.Fee), viper.GetString("blockexplorer_url"), resp.TxHash, resp.TxHash)
 
@@ -231,8 +270,11 @@ func (mtb *MoneroTipBot) parseCommandTIP() error {
 	if len(getrecipientid) == 2 {
 		if getrecipientid[1] == "0" {
 			msg := mtb.newReplyMessage(false)
+			msg.Receipt = true
 			// we dont have userID. so fallback to group chat
 			msg.ChatID = mtb.message.Chat.ID
+			// the recipient learns about the tip only from this announcement
+			msg.Keep = true
 
 			if mtb.message.Chat.IsGroup() || mtb.message.Chat.IsSuperGroup() {
 				msg.Text = fmt.Sprintf("@%s, you have been tipped with %f XMR from user @%s.\nPlease PM me (@%s) and click the 'Start' button to complete your account.", username, wallet.XMRToFloat64(amount), mtb.message.From.UserName, viper.GetString("BOT_NAME"))
@@ -243,6 +285,7 @@ func (mtb *MoneroTipBot) parseCommandTIP() error {
 			mtb.reply(msg)
 		} else {
 			msg := mtb.newReplyMessage(false)
+			msg.Receipt = true
 
 			recipientUserID, err := strconv.ParseInt(getrecipientid[1], 10, 64)
 			if err != nil {
@@ -267,21 +310,32 @@ func (mtb *MoneroTipBot) parseCommandTIP() error {
 				}
 			}
 
-			err = mtb.reply(msg)
-			if err != nil {
-				msg.ChatID = mtb.message.Chat.ID
-				// success on reaching out to user PM.
-				if mtb.message.Chat.IsGroup() || mtb.message.Chat.IsSuperGroup() {
-					msg.Text = fmt.Sprintf("@%s, you have been tipped with %f XMR from user @%s.", username, wallet.XMRToFloat64(amount), mtb.message.From.UserName)
+			// whether the PM reached the recipient is known once the outbox delivered it.
+			// Done runs after this update is gone, so it gets everything it needs now.
+			chat := mtb.message.Chat
+			tipper := mtb.message.From.UserName
+			confirmation := mtb.tipConfirmation(username, amount)
+			tippermsg.log = mtb.logger()
+			msg.Done = func(err error) {
+				if err == nil {
+					if confirmation != nil {
+						mtb.reply(confirmation)
+					}
+					tippermsg.Text = fmt.Sprintf("%s\n\nUser has been notified.", tippermsg.Text)
+					mtb.reply(tippermsg)
+					return
 				}
-				if mtb.message.Chat.IsPrivate() {
-					msg.Text = fmt.Sprintf("Silently tipped @%s with %f XMR. Notification failed. Please notify the user of starting this bot (@%s).", username, wallet.XMRToFloat64(amount), viper.GetString("BOT_NAME"))
+				fallback := &Message{ChatID: chat.ID, Keep: true, Receipt: true, log: tippermsg.log}
+				if chat.IsGroup() || chat.IsSuperGroup() {
+					fallback.Text = fmt.Sprintf("@%s, you have been tipped with %f XMR from user @%s.", username, wallet.XMRToFloat64(amount), tipper)
 				}
-				mtb.reply(msg)
-				return mtb.reply(tippermsg)
+				if chat.IsPrivate() {
+					fallback.Text = fmt.Sprintf("Silently tipped @%s with %f XMR. Notification failed. Please notify the user of starting this bot (@%s).", username, wallet.XMRToFloat64(amount), viper.GetString("BOT_NAME"))
+				}
+				mtb.reply(fallback)
+				mtb.reply(tippermsg)
 			}
-			tippermsg.Text = fmt.Sprintf("%s\n\nUser has been notified.", tippermsg.Text)
-			return mtb.reply(tippermsg)
+			return mtb.reply(msg)
 		}
 	}
 
@@ -292,11 +346,11 @@ func (mtb *MoneroTipBot) parseCommandSEND() error {
 	msg := mtb.newReplyMessage(true)
 
 	if len(mtb.message.CommandArguments()) == 0 {
-		msg.Text = "Please specify an address and amount to send: /send ADDRESSHERE 0.00042"
+		msg.Text = "Please specify an address and amount to send (with optional priority): /send ADDRESSHERE 0.00042 normal"
 		return mtb.reply(msg)
 	}
 	split := strings.Split(mtb.message.CommandArguments(), " ")
-	if len(split) != 2 {
+	if len(split) != 2 && len(split) != 3 {
 		msg.Text = "Need correct amount of command arguments."
 		return mtb.reply(msg)
 	}
@@ -311,6 +365,12 @@ func (mtb *MoneroTipBot) parseCommandSEND() error {
 
 	destinationaddress := split[0]
 
+	err := mtb.checkWhitelist(destinationaddress)
+	if err != nil {
+		msg.Text = err.Error()
+		return mtb.reply(msg)
+	}
+
 	if strings.ContainsAny(split[1], ",") {
 		split[1] = strings.Replace(split[1], ",", ".", -1)
 	}
@@ -327,6 +387,28 @@ func (mtb *MoneroTipBot) parseCommandSEND() error {
 
 	amount := wallet.Float64ToXMR(parseamount)
 
+	priority := wallet.PriorityDefault
+	if len(split) == 3 {
+		priority, err = parsePriority(split[2])
+		if err != nil {
+			msg.Text = err.Error()
+			return mtb.reply(msg)
+		}
+	}
+
+	err = mtb.checkLimits(int64(mtb.from.ID), amount, false)
+	if err != nil {
+		msg.Text = err.Error()
+		return mtb.reply(msg)
+	}
+
+	if amount > wallet.Float64ToXMR(viper.GetFloat64("SECOND_FACTOR_SEND_THRESHOLD")) {
+		err = mtb.requireSecondFactor()
+		if err != nil {
+			return err
+		}
+	}
+
 	var destinations []*wallet.Destination
 	destinations = append(destinations, &wallet.Destination{
 		Amount:  amount,
@@ -338,20 +420,31 @@ func (mtb *MoneroTipBot) parseCommandSEND() error {
 		return err
 	}
 
+	if needsApproval(amount) {
+		return mtb.queueApproval(approvalKindSend, useraccount, destinationaddress, amount, priority)
+	}
+
 	// stat the transfer time
 	start := time.Now()
-	resp, err := mtb.walletrpc.Transfer(&wallet.RequestTransfer{
-		AccountIndex: useraccount.AccountIndex,
-		Destinations: destinations,
-	})
+	resp, err := mtb.transferFrom(useraccount.AccountIndex, destinations, priority)
+	entry := mtb.newAuditEntry("send")
+	entry.AccountIndex = useraccount.AccountIndex
+	entry.Counterparty = destinationaddress
+	entry.Amount = amount
 	if err != nil {
+		mtb.audit(entry.fail(err))
 		msg.Text = fmt.Sprintf("Error: %s", err)
 		return mtb.reply(msg)
 	}
-	mtb.statsdPrecisionTiming("transaction.time_to_complete", time.Since(start))
+	mtb.metricTiming("transaction.time_to_complete", time.Since(start))
 	// stat the transaction count
-	mtb.statsdIncr("transactions.counter", 1)
+	mtb.metricIncr("transactions.counter", 1)
+	entry.Fee = resp.Fee
+	entry.TxHash = resp.TxHash
+	mtb.audit(entry)
+	mtb.recordSpending(int64(mtb.from.ID), amount, false)
 
+	msg.Receipt = true
 	msg.Text = fmt.Sprintf("Successfully sent %f to address %s", wallet.XMRToFloat64(amount), destinationaddress)
 	mtb.reply(msg)
 	msg.Format = false
@@ -383,11 +476,17 @@ func (mtb *MoneroTipBot) parseCommandGIVEAWAY() error {
 		msg.Text = "Could not parse the amount. Aborted"
 		return mtb.reply(msg)
 	}
-	if parseamount < viper.GetFloat64("MIN_TIP_AMOUNT") {
+	if parseamount < mtb.minTipAmount() {
 		if !mtb.message.Chat.IsPrivate() {
 			msg.ChatID = mtb.message.Chat.ID
 		}
-		msg.Text = fmt.Sprintf("Minimum amount for a tip is %f XMR", viper.GetFloat64("MIN_TIP_AMOUNT"))
+		msg.Text = fmt.Sprintf("Minimum amount for a tip is %f XMR", mtb.minTipAmount())
+		return mtb.reply(msg)
+	}
+
+	err = mtb.checkLimits(int64(mtb.from.ID), wallet.Float64ToXMR(parseamount), true)
+	if err != nil {
+		msg.Text = err.Error()
 		return mtb.reply(msg)
 	}
 
@@ -396,7 +495,7 @@ func (mtb *MoneroTipBot) parseCommandGIVEAWAY() error {
 		return err
 	}
 
-	if useraccount.UnlockedBalance < wallet.Float64ToXMR(parseamount) {
+	if useraccount.UnlockedBalance+mtb.coldBalance(useraccount.AccountIndex) < wallet.Float64ToXMR(parseamount) {
 		if !mtb.message.Chat.IsPrivate() {
 			msg.ChatID = mtb.message.Chat.ID
 		}
@@ -411,7 +510,7 @@ func (mtb *MoneroTipBot) parseCommandGIVEAWAY() error {
 	giveawaymsg := tgbotapi.NewMessage(mtb.message.Chat.ID, "")
 	giveawaymsg.ReplyMarkup = markup
 	giveawaymsg.Text = giveawaytext
-	resp, _ := mtb.bot.Send(giveawaymsg)
+	resp, _ := mtb.sendWait(giveawaymsg)
 
 	giveaway := &Giveaway{
 		Message: &resp,
@@ -420,18 +519,39 @@ func (mtb *MoneroTipBot) parseCommandGIVEAWAY() error {
 		Amount:  wallet.Float64ToXMR(parseamount),
 	}
 	mtb.giveaways = append(mtb.giveaways, giveaway)
+	entry := mtb.newAuditEntry("giveaway_create")
+	entry.AccountIndex = useraccount.AccountIndex
+	entry.Amount = giveaway.Amount
+	entry.Details = fmt.Sprintf("giveaway message %d", resp.MessageID)
+	mtb.audit(entry)
+	// the amount is counted when the giveaway is claimed. only the tip cooldown starts now.
+	mtb.recordSpending(int64(mtb.from.ID), 0, true)
 	return mtb.saveGiveawayToFile()
 }
 
 func (mtb *MoneroTipBot) parseCommandWITHDRAW() error {
 	msg := mtb.newReplyMessage(true)
 
-	if len(mtb.message.CommandArguments()) == 0 {
-		msg.Text = "Please specify destination address to withdraw to: /withdraw ADDRESSHERE"
+	split := strings.Fields(mtb.message.CommandArguments())
+	if len(split) == 0 {
+		msg.Text = "Please specify destination address to withdraw to (with optional priority): /withdraw ADDRESSHERE normal"
+		return mtb.reply(msg)
+	}
+	if len(split) > 2 {
+		msg.Text = "Need correct amount of command arguments."
 		return mtb.reply(msg)
 	}
+	withdrawaddress := split[0]
 
-	withdrawaddress := mtb.message.CommandArguments()
+	priority := wallet.PriorityDefault
+	if len(split) == 2 {
+		var err error
+		priority, err = parsePriority(split[1])
+		if err != nil {
+			msg.Text = err.Error()
+			return mtb.reply(msg)
+		}
+	}
 
 	validaddr, err := mtb.walletrpc.ValidateAddress(&wallet.RequestValidateAddress{Address: withdrawaddress, AnyNetType: viper.GetBool("IS_STAGENET_WALLET")})
 	if err != nil {
@@ -443,28 +563,54 @@ func (mtb *MoneroTipBot) parseCommandWITHDRAW() error {
 		return mtb.reply(msg)
 	}
 
+	err = mtb.checkWhitelist(withdrawaddress)
+	if err != nil {
+		msg.Text = err.Error()
+		return mtb.reply(msg)
+	}
+
+	err = mtb.requireSecondFactor()
+	if err != nil {
+		return err
+	}
+
 	useraccount, err := mtb.getUserAccount()
 	if err != nil {
 		return err
 	}
 
+	// the pooled balance is withdrawn as well
+	withdrawable := useraccount.UnlockedBalance + mtb.coldBalance(useraccount.AccountIndex)
+	if needsApproval(withdrawable) {
+		return mtb.queueApproval(approvalKindWithdraw, useraccount, withdrawaddress, withdrawable, priority)
+	}
+
 	// stat the transfer time
 	start := time.Now()
-	resp, err := mtb.walletrpc.SweepAll(&wallet.RequestSweepAll{
-		AccountIndex:      useraccount.AccountIndex,
-		Address:           mtb.message.CommandArguments(),
-		SubaddrIndicesAll: true,
-	})
+	withdrawal, err := mtb.withdrawAll(useraccount.AccountIndex, withdrawaddress, priority)
+	entry := mtb.newAuditEntry("withdraw")
+	entry.AccountIndex = useraccount.AccountIndex
+	entry.Counterparty = withdrawaddress
+	entry.Amount = withdrawal.Amount
+	entry.Fee = withdrawal.Fee
+	entry.TxHash = strings.Join(withdrawal.TxHashes, ",")
 	if err != nil {
+		mtb.audit(entry.fail(err))
 		msg.Text = fmt.Sprintf("Error: %s", err)
+		if len(withdrawal.TxHashes) > 0 {
+			msg.Format = false
+			msg.Text = fmt.Sprintf("Withdraw incomplete: %s\n\nSent so far:\n%s\n", err, withdrawal)
+		}
 		return mtb.reply(msg)
 	}
-	mtb.statsdPrecisionTiming("transaction.time_to_complete", time.Since(start))
+	mtb.metricTiming("transaction.time_to_complete", time.Since(start))
 	// stat the transaction count
-	mtb.statsdIncr("transactions.counter", 1)
+	mtb.metricIncr("transactions.counter", 1)
+	mtb.audit(entry)
 
 	msg.Format = false
-	msg.Text = fmt.Sprintf("Withdraw successful.\n\nAmount: %f\nFee: %f\nTxHash: <a href='%s%s'>%s</a>\n", wallet.XMRToFloat64(resp.AmountList[0]), wallet.XMRToFloat64(resp.FeeList[0]), viper.GetString("blockexplorer_url"), resp.TxHashList[0], resp.TxHashList[0])
+	msg.Receipt = true
+	msg.Text = fmt.Sprintf("Withdraw successful.\n\n%s\n", withdrawal)
 	return mtb.reply(msg)
 }
 
@@ -482,8 +628,17 @@ func (mtb *MoneroTipBot) parseCommandBALANCE() error {
 		return mtb.reply(msg)
 	}
 
+	coldbalance := mtb.coldBalance(useraccount.AccountIndex)
+	var coldtext string
+	if coldbalance > 0 {
+		coldtext = fmt.Sprintf("\nPooled: %f (held by the bot, spendable like the rest of your balance)", wallet.XMRToFloat64(coldbalance))
+	}
+
 	if balances.PerSubaddress == nil {
 		msg.Text = "Account has no funds. No balance to show."
+		if coldbalance > 0 {
+			msg.Text = fmt.Sprintf("Account has no funds of its own.%s", coldtext)
+		}
 		mtb.reply(msg)
 		msg.Text = useraccount.BaseAddress
 		return mtb.reply(msg)
@@ -511,10 +666,10 @@ func (mtb *MoneroTipBot) parseCommandBALANCE() error {
 	}
 
 	if sumblockstounlock > 0 {
-		msg.Text = fmt.Sprintf("Balance: %f\nUnlocked Balance: %f\nBlocks To Unlock (accumulated): %d (~%d minutes)\nUnspent Outputs: %d\nAddress: ...", wallet.XMRToFloat64(uint64(totalbalance)), wallet.XMRToFloat64(uint64(totalunlockedbalance)), sumblockstounlock, sumblockstounlock*2, totalnumunspentoutputs)
+		msg.Text = fmt.Sprintf("Balance: %f\nUnlocked Balance: %f\nBlocks To Unlock (accumulated): %d (~%d minutes)\nUnspent Outputs: %d%s\nAddress: ...", wallet.XMRToFloat64(uint64(totalbalance)), wallet.XMRToFloat64(uint64(totalunlockedbalance)), sumblockstounlock, sumblockstounlock*2, totalnumunspentoutputs, coldtext)
 		mtb.reply(msg)
 	} else {
-		msg.Text = fmt.Sprintf("Balance: %f\nUnlocked Balance: %f\nBlocks To Unlock: %d\nUnspent Outputs: %d\nAddress: ...", wallet.XMRToFloat64(uint64(totalbalance)), wallet.XMRToFloat64(uint64(totalunlockedbalance)), sumblockstounlock, totalnumunspentoutputs)
+		msg.Text = fmt.Sprintf("Balance: %f\nUnlocked Balance: %f\nBlocks To Unlock: %d\nUnspent Outputs: %d%s\nAddress: ...", wallet.XMRToFloat64(uint64(totalbalance)), wallet.XMRToFloat64(uint64(totalunlockedbalance)), sumblockstounlock, totalnumunspentoutputs, coldtext)
 		mtb.reply(msg)
 	}
 	msg.Text = useraccount.BaseAddress
@@ -553,10 +708,7 @@ func (mtb *MoneroTipBot) parseCommandGENERATEQR() error {
 
 		fb := tgbotapi.FileBytes{Name: "image.png", Bytes: buf.Bytes()}
 		photomsg := tgbotapi.NewPhotoUpload(mtb.getReplyID(), fb)
-		_, err = mtb.bot.Send(photomsg)
-		if err != nil {
-			return err
-		}
+		mtb.send(photomsg)
 
 		return nil
 	}
@@ -608,12 +760,9 @@ func (mtb *MoneroTipBot) parseCommandGENERATEQR() error {
 
 	fb := tgbotapi.FileBytes{Name: "image.png", Bytes: buf.Bytes()}
 	photomsg := tgbotapi.NewPhotoUpload(mtb.getReplyID(), fb)
-	_, err = mtb.bot.Send(photomsg)
-	if err != nil {
-		return err
-	}
+	mtb.send(photomsg)
 
-	mtb.statsdIncr("qrcode_generated.counter", 1)
+	mtb.metricIncr("qrcode_generated.counter", 1)
 
 	return nil
 }
@@ -2,7 +2,7 @@ package monerotipbot
 
 const (
 	// START command for starting the bot
-	START = string(iota + 1)
+	START = string(rune(iota + 1))
 	// HELP command for showing usage of bot
 	HELP
 	// TIP command for tipping users
@@ -17,16 +17,49 @@ const (
 	BALANCE
 	// GENERATEQR command for generating QR-Codes (images)
 	GENERATEQR
+	// WHITELIST command for managing the withdrawal address whitelist
+	WHITELIST
+	// SECURITY command for managing the second factor (PIN or TOTP)
+	SECURITY
+	// CONFIRM command for confirming a request with the second factor
+	CONFIRM
+	// LIMITS command for showing and lowering spending limits
+	LIMITS
+	// FEE command for showing estimated fees per priority
+	FEE
+	// PROOF command for creating transaction proofs
+	PROOF
+	// CHECKPROOF command for verifying transaction proofs
+	CHECKPROOF
+	// RESERVES command for showing the latest proof of reserves
+	RESERVES
+	// REJECT command for rejecting a send or withdrawal waiting for approval
+	REJECT
+	// ADMIN command for operating the bot
+	ADMIN
+	// GROUPSETTINGS command for the settings group admins make for their group
+	GROUPSETTINGS
 )
 
 // COMMANDS defines all Telegram commands this bot has
 var COMMANDS = map[string]string{
-	START:      "start",
-	HELP:       "help",
-	TIP:        "tip",
-	SEND:       "send",
-	GIVEAWAY:   "giveaway",
-	WITHDRAW:   "withdraw",
-	BALANCE:    "balance",
-	GENERATEQR: "generateqr",
+	START:         "start",
+	HELP:          "help",
+	TIP:           "tip",
+	SEND:          "send",
+	GIVEAWAY:      "giveaway",
+	WITHDRAW:      "withdraw",
+	BALANCE:       "balance",
+	GENERATEQR:    "generateqr",
+	WHITELIST:     "whitelist",
+	SECURITY:      "security",
+	CONFIRM:       "confirm",
+	LIMITS:        "limits",
+	FEE:           "fee",
+	PROOF:         "proof",
+	CHECKPROOF:    "checkproof",
+	RESERVES:      "reserves",
+	REJECT:        "reject",
+	ADMIN:         "admin",
+	GROUPSETTINGS: "groupsettings",
 }
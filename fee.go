@@ -0,0 +1,107 @@
+package monerotipbot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/omani/go-monero-rpc-client/wallet"
+	"github.com/spf13/viper"
+)
+
+// PRIORITYNAMES are the transaction priorities users can choose from, in ascending order
+var PRIORITYNAMES = []string{"slow", "normal", "fast", "fastest"}
+
+// PRIORITIES maps the priority names to the priorities of the wallet RPC
+var PRIORITIES = map[string]wallet.Priority{
+	"slow":    wallet.PriorityUnimportant,
+	"normal":  wallet.PriorityNormal,
+	"fast":    wallet.PriorityElevated,
+	"fastest": wallet.Priority(4),
+}
+
+func parsePriority(name string) (wallet.Priority, error) {
+	priority, ok := PRIORITIES[strings.ToLower(name)]
+	if !ok {
+		return wallet.PriorityDefault, fmt.Errorf("Unknown priority %s. Use one of: %s", name, strings.Join(PRIORITYNAMES, ", "))
+	}
+	return priority, nil
+}
+
+// tipPriority is the priority of transfers between accounts of this bot (tips and giveaways)
+func tipPriority() wallet.Priority {
+	priority, err := parsePriority(viper.GetString("TIP_PRIORITY"))
+	if err != nil {
+		return wallet.PriorityDefault
+	}
+	return priority
+}
+
+// estimateFees estimates the fee of a transfer of amount for every priority with a transfer of the primary account to
+// itself that is never relayed. The primary account is the pool, so no user account is touched.
+func (mtb *MoneroTipBot) estimateFees(amount uint64) (*FeeEstimate, error) {
+	balance, err := mtb.walletrpc.GetBalance(&wallet.RequestGetBalance{AccountIndex: 0})
+	if err != nil {
+		return nil, err
+	}
+	if balance.UnlockedBalance <= amount {
+		return nil, fmt.Errorf("The primary account has not enough unlocked funds")
+	}
+	address, err := mtb.walletrpc.GetAddress(&wallet.RequestGetAddress{AccountIndex: 0})
+	if err != nil {
+		return nil, err
+	}
+
+	estimate := &FeeEstimate{
+		Time:   time.Now(),
+		Amount: amount,
+		Fees:   make(map[string]uint64),
+	}
+	for _, name := range PRIORITYNAMES {
+		resp, err := mtb.walletrpc.Transfer(&wallet.RequestTransfer{
+			AccountIndex: 0,
+			Destinations: []*wallet.Destination{{Amount: amount, Address: address.Address}},
+			Priority:     PRIORITIES[name],
+			DoNotRelay:   true,
+		})
+		if err != nil {
+			continue
+		}
+		estimate.Fees[name] = resp.Fee
+	}
+	if len(estimate.Fees) == 0 {
+		return nil, fmt.Errorf("The wallet could not estimate any fee")
+	}
+	return estimate, nil
+}
+
+func (mtb *MoneroTipBot) parseCommandFEE() error {
+	msg := mtb.newReplyMessage(true)
+
+	estimate, err := mtb.estimateFees(wallet.Float64ToXMR(viper.GetFloat64("MIN_TIP_AMOUNT")))
+	if err != nil {
+		mtb.logger().WithError(err).Warn("Could not estimate fees")
+		if mtb.feeestimate == nil {
+			msg.Text = "Could not estimate fees right now. Try again later."
+			return mtb.reply(msg)
+		}
+		// the fees don't change much within a few hours
+		estimate = mtb.feeestimate
+		msg.Text = fmt.Sprintf("Could not estimate fees right now. This is the last estimate, from %s.\n\n", estimate.Time.Format(time.RFC1123))
+	} else {
+		mtb.feeestimate = estimate
+	}
+
+	msg.Text = fmt.Sprintf("%sEstimated fees for a transfer of %f XMR:\n", msg.Text, wallet.XMRToFloat64(estimate.Amount))
+	for _, name := range PRIORITYNAMES {
+		fee, ok := estimate.Fees[name]
+		if !ok {
+			msg.Text = fmt.Sprintf("%s\n%-8s n/a", msg.Text, name)
+			continue
+		}
+		msg.Text = fmt.Sprintf("%s\n%-8s %f XMR", msg.Text, name, wallet.XMRToFloat64(fee))
+	}
+	msg.Text = fmt.Sprintf("%s\n\nChoose a priority with /send ADDRESS AMOUNT PRIORITY or /withdraw ADDRESS PRIORITY", msg.Text)
+
+	return mtb.reply(msg)
+}
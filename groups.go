@@ -0,0 +1,275 @@
+package monerotipbot
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omani/go-monero-rpc-client/wallet"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+var groupsmutex sync.Mutex
+
+// loadGroups reads the group registry from GROUPS_FILE. A missing file means no groups yet.
+func loadGroups() (map[int64]*Group, error) {
+	groups := make(map[int64]*Group)
+
+	file, err := ioutil.ReadFile(viper.GetString("GROUPS_FILE"))
+	if err != nil {
+		return groups, nil
+	}
+
+	err = json.Unmarshal(file, &groups)
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// saveGroupsToFile must be called with groupsmutex held
+func (mtb *MoneroTipBot) saveGroupsToFile() error {
+	file, err := json.MarshalIndent(mtb.groups, "", " ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(viper.GetString("GROUPS_FILE"), file, 0600)
+	if err != nil {
+		// stay dirty, so groupsScheduler tries again
+		return err
+	}
+	mtb.groupsdirty = false
+	return nil
+}
+
+// group returns the registry entry of chat and creates it on first sight. Must be called with groupsmutex held.
+func (mtb *MoneroTipBot) group(chat *tgbotapi.Chat) *Group {
+	group, ok := mtb.groups[chat.ID]
+	if !ok {
+		group = &Group{
+			ID:        chat.ID,
+			FirstSeen: time.Now().UTC(),
+			Members:   make(map[int]int64),
+		}
+		mtb.groups[chat.ID] = group
+	}
+	// titles and usernames of groups can change
+	group.Title = chat.Title
+	group.Type = chat.Type
+	group.Username = chat.UserName
+	return group
+}
+
+// trackGroupMessage counts a message of from in a group. The registry is saved by groupsScheduler,
+// so busy groups don't cause a write on every message.
+func (mtb *MoneroTipBot) trackGroupMessage(chat *tgbotapi.Chat, from *tgbotapi.User) {
+	if chat == nil || chat.IsPrivate() || chat.IsChannel() {
+		return
+	}
+
+	groupsmutex.Lock()
+	defer groupsmutex.Unlock()
+
+	group := mtb.group(chat)
+	group.Messages++
+	group.LastActivity = time.Now().UTC()
+	if from != nil && !from.IsBot {
+		group.Members[from.ID]++
+	}
+	mtb.groupsdirty = true
+}
+
+// groupJoined records the bot being added to chat
+func (mtb *MoneroTipBot) groupJoined(chat *tgbotapi.Chat) {
+	groupsmutex.Lock()
+	defer groupsmutex.Unlock()
+
+	group := mtb.group(chat)
+	group.Joined = time.Now().UTC()
+	group.Left = time.Time{}
+	err := mtb.saveGroupsToFile()
+	if err != nil {
+		mtb.logger().WithError(err).Error("Error while saving groups")
+	}
+	mtb.logger().WithFields(logrus.Fields{"group_id": chat.ID, "title": chat.Title}).Info("Bot joined group")
+}
+
+// groupLeft records the bot being removed from chat
+func (mtb *MoneroTipBot) groupLeft(chat *tgbotapi.Chat) {
+	groupsmutex.Lock()
+	defer groupsmutex.Unlock()
+
+	group := mtb.group(chat)
+	group.Left = time.Now().UTC()
+	err := mtb.saveGroupsToFile()
+	if err != nil {
+		mtb.logger().WithError(err).Error("Error while saving groups")
+	}
+	mtb.logger().WithFields(logrus.Fields{"group_id": chat.ID, "title": chat.Title}).Info("Bot left group")
+}
+
+// recordGroupTip adds a tip or a claimed giveaway to the tip volume of chat
+func (mtb *MoneroTipBot) recordGroupTip(chat *tgbotapi.Chat, amount uint64) {
+	if chat == nil || chat.IsPrivate() {
+		return
+	}
+
+	groupsmutex.Lock()
+	defer groupsmutex.Unlock()
+
+	group := mtb.group(chat)
+	group.Tips++
+	group.TipVolume += amount
+	mtb.groupsdirty = true
+}
+
+// groupsScheduler saves the registry every minute if something changed
+func (mtb *MoneroTipBot) groupsScheduler() {
+	for {
+		time.Sleep(time.Minute)
+
+		groupsmutex.Lock()
+		if mtb.groupsdirty {
+			err := mtb.saveGroupsToFile()
+			if err != nil {
+				jobLogger("groups").WithError(err).Error("Error while saving groups")
+			}
+		}
+		active := 0
+		for _, group := range mtb.groups {
+			if group.IsActive() {
+				active++
+			}
+		}
+		groupsmutex.Unlock()
+
+		mtb.metricGauge("groups.active", float64(active))
+	}
+}
+
+// IsActive reports whether the bot is still in the group, as far as we know.
+// Groups the bot was added to before the registry existed have no join date.
+func (group *Group) IsActive() bool {
+	return group.Left.IsZero() || group.Joined.After(group.Left)
+}
+
+// sortedGroups returns the groups by tip volume, then by messages. Must be called with groupsmutex held.
+func (mtb *MoneroTipBot) sortedGroups() []*Group {
+	var groups []*Group
+	for _, group := range mtb.groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].TipVolume != groups[j].TipVolume {
+			return groups[i].TipVolume > groups[j].TipVolume
+		}
+		return groups[i].Messages > groups[j].Messages
+	})
+	return groups
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (group *Group) String() string {
+	status := "active"
+	if !group.IsActive() {
+		status = fmt.Sprintf("left %s", group.Left.Format("2006-01-02"))
+	}
+	return fmt.Sprintf("%s (%d, %s, %s)\nMessages: %d, members: %d, tips: %d, volume: %f XMR", group.Title, group.ID, group.Type, status, group.Messages, len(group.Members), group.Tips, wallet.XMRToFloat64(group.TipVolume))
+}
+
+// exportGroupsCSV writes one line per group. Must be called with groupsmutex held.
+func (mtb *MoneroTipBot) exportGroupsCSV() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"id", "title", "type", "username", "active", "first_seen", "joined", "left", "last_activity", "messages", "members", "tips", "tip_volume_xmr"})
+	for _, group := range mtb.sortedGroups() {
+		w.Write([]string{
+			strconv.FormatInt(group.ID, 10),
+			group.Title,
+			group.Type,
+			group.Username,
+			strconv.FormatBool(group.IsActive()),
+			formatTime(group.FirstSeen),
+			formatTime(group.Joined),
+			formatTime(group.Left),
+			formatTime(group.LastActivity),
+			strconv.FormatInt(group.Messages, 10),
+			strconv.Itoa(len(group.Members)),
+			strconv.FormatInt(group.Tips, 10),
+			wallet.XMRToDecimal(group.TipVolume),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// parseCommandADMINGROUPS handles /admin groups [GROUPID|export]
+func (mtb *MoneroTipBot) parseCommandADMINGROUPS(msg *Message, arg string) error {
+	groupsmutex.Lock()
+	defer groupsmutex.Unlock()
+
+	if arg == "export" {
+		mtb.auditAdmin("groups export")
+		data, err := mtb.exportGroupsCSV()
+		if err != nil {
+			msg.Text = fmt.Sprintf("Error while exporting groups: %s", err)
+			return mtb.reply(msg)
+		}
+		document := tgbotapi.NewDocumentUpload(msg.ChatID, tgbotapi.FileBytes{Name: "groups.csv", Bytes: data})
+		mtb.send(document)
+		return nil
+	}
+
+	if len(arg) > 0 {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			msg.Text = "Usage: /admin groups [GROUPID|export]"
+			return mtb.reply(msg)
+		}
+		group, ok := mtb.groups[id]
+		if !ok {
+			msg.Text = fmt.Sprintf("Group %d is unknown.", id)
+			return mtb.reply(msg)
+		}
+		mtb.auditAdmin(fmt.Sprintf("groups %d", id))
+		msg.Text = fmt.Sprintf("%s\n\nUsername: %s\nFirst seen: %s\nJoined: %s\nLeft: %s\nLast activity: %s", group, group.Username, formatTime(group.FirstSeen), formatTime(group.Joined), formatTime(group.Left), formatTime(group.LastActivity))
+		return mtb.reply(msg)
+	}
+
+	mtb.auditAdmin("groups")
+	groups := mtb.sortedGroups()
+	active := 0
+	for _, group := range groups {
+		if group.IsActive() {
+			active++
+		}
+	}
+	var lines []string
+	for i, group := range groups {
+		// keep the message below the Telegram size limit. the export has all of them.
+		if i == 20 {
+			lines = append(lines, fmt.Sprintf("... and %d more. Use /admin groups export.", len(groups)-i))
+			break
+		}
+		lines = append(lines, group.String())
+	}
+	msg.Text = fmt.Sprintf("Groups: %d (%d active)\n\n%s", len(groups), active, strings.Join(lines, "\n\n"))
+	return mtb.reply(msg)
+}
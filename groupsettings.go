@@ -0,0 +1,235 @@
+package monerotipbot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omani/go-monero-rpc-client/wallet"
+	"github.com/spf13/viper"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// groupcommands are the commands the admins of a group can disable there
+var groupcommands = []string{COMMANDS[TIP], COMMANDS[GIVEAWAY]}
+
+// groupSettings returns a copy of the settings of the group chatid. The zero value if there are none.
+func (mtb *MoneroTipBot) groupSettings(chatid int64) GroupSettings {
+	groupsmutex.Lock()
+	defer groupsmutex.Unlock()
+
+	group, ok := mtb.groups[chatid]
+	if !ok || group.Settings == nil {
+		return GroupSettings{}
+	}
+	settings := *group.Settings
+	settings.Disabled = append([]string(nil), group.Settings.Disabled...)
+	return settings
+}
+
+// IsDisabled reports whether command can't be used in the group
+func (settings GroupSettings) IsDisabled(command string) bool {
+	for _, disabled := range settings.Disabled {
+		if disabled == command {
+			return true
+		}
+	}
+	return false
+}
+
+func (settings GroupSettings) String() string {
+	mintip := fmt.Sprintf("%f XMR", viper.GetFloat64("MIN_TIP_AMOUNT"))
+	if settings.MinTip > viper.GetFloat64("MIN_TIP_AMOUNT") {
+		mintip = fmt.Sprintf("%f XMR", settings.MinTip)
+	}
+	var commands []string
+	for _, command := range groupcommands {
+		status := "enabled"
+		if settings.IsDisabled(command) {
+			status = "disabled"
+		}
+		commands = append(commands, fmt.Sprintf("/%s: %s", command, status))
+	}
+	confirmations := "PM only"
+	if settings.PublicConfirmations {
+		confirmations = "public"
+	}
+	return fmt.Sprintf("Minimum tip: %s\n%s\nTip confirmations: %s", mintip, strings.Join(commands, "\n"), confirmations)
+}
+
+// isCommandDisabled reports whether the admins of the current group disabled command
+func (mtb *MoneroTipBot) isCommandDisabled(command string) bool {
+	if mtb.message.Chat.IsPrivate() {
+		return false
+	}
+	return mtb.groupSettings(mtb.message.Chat.ID).IsDisabled(command)
+}
+
+// minTipAmount is MIN_TIP_AMOUNT, or the minimum tip of the current group if its admins set a higher one
+func (mtb *MoneroTipBot) minTipAmount() float64 {
+	mintip := viper.GetFloat64("MIN_TIP_AMOUNT")
+	if mtb.message.Chat.IsPrivate() {
+		return mintip
+	}
+	settings := mtb.groupSettings(mtb.message.Chat.ID)
+	if settings.MinTip > mintip {
+		return settings.MinTip
+	}
+	return mintip
+}
+
+// tipConfirmation is the post of the tip to the current group if its admins turned on public confirmations. nil otherwise.
+func (mtb *MoneroTipBot) tipConfirmation(username string, amount uint64) *Message {
+	if mtb.message.Chat.IsPrivate() || !mtb.groupSettings(mtb.message.Chat.ID).PublicConfirmations {
+		return nil
+	}
+	return &Message{
+		Text:    fmt.Sprintf("@%s tipped @%s %f XMR.", mtb.message.From.UserName, username, wallet.XMRToFloat64(amount)),
+		ChatID:  mtb.message.Chat.ID,
+		Keep:    true,
+		Receipt: true,
+		log:     mtb.logger(),
+	}
+}
+
+// isGroupAdmin asks Telegram whether the sender is the creator or an administrator of the current group
+func (mtb *MoneroTipBot) isGroupAdmin() (bool, error) {
+	member, err := mtb.bot.GetChatMember(tgbotapi.ChatConfigWithUser{
+		ChatID: mtb.message.Chat.ID,
+		UserID: mtb.from.ID,
+	})
+	if err != nil {
+		return false, err
+	}
+	return member.IsCreator() || member.IsAdministrator(), nil
+}
+
+// updateGroupSettings applies change to a copy of the settings of the current group and saves the registry with it.
+// The new settings only take effect if they were saved.
+func (mtb *MoneroTipBot) updateGroupSettings(change func(settings *GroupSettings)) (GroupSettings, error) {
+	groupsmutex.Lock()
+	defer groupsmutex.Unlock()
+
+	group := mtb.group(mtb.message.Chat)
+	settings := GroupSettings{}
+	if group.Settings != nil {
+		settings = *group.Settings
+		settings.Disabled = append([]string(nil), group.Settings.Disabled...)
+	}
+	change(&settings)
+	settings.UpdatedBy = int64(mtb.from.ID)
+	settings.Updated = time.Now().UTC()
+
+	// the registry is saved as a whole, so the copy goes in for the write and back out if it fails
+	previous := group.Settings
+	group.Settings = &settings
+	err := mtb.saveGroupsToFile()
+	if err != nil {
+		group.Settings = previous
+		return GroupSettings{}, err
+	}
+	return settings, nil
+}
+
+func (mtb *MoneroTipBot) parseCommandGROUPSETTINGS() error {
+	msg := mtb.newReplyMessage(true)
+
+	if !mtb.message.Chat.IsGroup() && !mtb.message.Chat.IsSuperGroup() {
+		msg.Text = "Group settings can only be changed in the group. Aborting."
+		return mtb.reply(msg)
+	}
+
+	admin, err := mtb.isGroupAdmin()
+	if err != nil {
+		msg.Text = fmt.Sprintf("Error while checking your permissions: %s", err)
+		return mtb.reply(msg)
+	}
+	if !admin {
+		msg.Text = "Only the admins of this group can change its settings."
+		return mtb.reply(msg)
+	}
+
+	// the settings are public to the group anyway
+	msg.ChatID = mtb.message.Chat.ID
+
+	split := strings.Fields(mtb.message.CommandArguments())
+	if len(split) == 0 {
+		msg.Text = fmt.Sprintf("Settings of this group:\n\n%s", mtb.groupSettings(mtb.message.Chat.ID))
+		return mtb.reply(msg)
+	}
+
+	usage := fmt.Sprintf("Usage:\n/groupsettings\n/groupsettings mintip AMOUNT|off\n/groupsettings enable|disable %s\n/groupsettings confirmations public|pm", strings.Join(groupcommands, "|"))
+	if len(split) != 2 {
+		msg.Text = usage
+		return mtb.reply(msg)
+	}
+
+	var change func(settings *GroupSettings)
+	switch split[0] {
+	case "mintip":
+		var mintip float64
+		if split[1] != "off" {
+			mintip, err = strconv.ParseFloat(strings.Replace(split[1], ",", ".", -1), 64)
+			if err != nil {
+				msg.Text = "Could not parse amount."
+				return mtb.reply(msg)
+			}
+			if mintip < viper.GetFloat64("MIN_TIP_AMOUNT") {
+				msg.Text = fmt.Sprintf("The minimum tip can't be lower than %f XMR.", viper.GetFloat64("MIN_TIP_AMOUNT"))
+				return mtb.reply(msg)
+			}
+		}
+		change = func(settings *GroupSettings) {
+			settings.MinTip = mintip
+		}
+	case "enable", "disable":
+		command := strings.TrimPrefix(strings.ToLower(split[1]), "/")
+		known := false
+		for _, groupcommand := range groupcommands {
+			if command == groupcommand {
+				known = true
+			}
+		}
+		if !known {
+			msg.Text = usage
+			return mtb.reply(msg)
+		}
+		change = func(settings *GroupSettings) {
+			var disabled []string
+			for _, c := range settings.Disabled {
+				if c != command {
+					disabled = append(disabled, c)
+				}
+			}
+			if split[0] == "disable" {
+				disabled = append(disabled, command)
+			}
+			settings.Disabled = disabled
+		}
+	case "confirmations":
+		if split[1] != "public" && split[1] != "pm" {
+			msg.Text = usage
+			return mtb.reply(msg)
+		}
+		change = func(settings *GroupSettings) {
+			settings.PublicConfirmations = split[1] == "public"
+		}
+	default:
+		msg.Text = usage
+		return mtb.reply(msg)
+	}
+
+	entry := mtb.newAuditEntry("group_settings")
+	entry.Details = strings.Join(split, " ")
+	settings, err := mtb.updateGroupSettings(change)
+	if err != nil {
+		mtb.audit(entry.fail(err))
+		msg.Text = fmt.Sprintf("Error while saving the group settings: %s", err)
+		return mtb.reply(msg)
+	}
+	mtb.audit(entry)
+
+	msg.Text = fmt.Sprintf("Settings of this group updated by @%s:\n\n%s", mtb.getUsername(), settings)
+	return mtb.reply(msg)
+}
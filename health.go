@@ -0,0 +1,185 @@
+package monerotipbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var healthmutex sync.Mutex
+
+// getDaemonInfo asks the daemon at monero_daemon_url for its height and sync state
+func getDaemonInfo() (height uint64, targetheight uint64, synchronized bool, err error) {
+	body := []byte(`{"jsonrpc":"2.0","id":"0","method":"get_info"}`)
+
+	client := &http.Client{Timeout: time.Second * 10}
+	resp, err := client.Post(viper.GetString("monero_daemon_url"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer resp.Body.Close()
+
+	info := &struct {
+		Result struct {
+			Height       uint64 `json:"height"`
+			TargetHeight uint64 `json:"target_height"`
+			Synchronized bool   `json:"synchronized"`
+		} `json:"result"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(info)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if info.Error != nil {
+		return 0, 0, false, errors.New(info.Error.Message)
+	}
+
+	return info.Result.Height, info.Result.TargetHeight, info.Result.Synchronized, nil
+}
+
+// checkHealth compares the wallet height with the daemon height and measures the latency of the wallet RPC
+func (mtb *MoneroTipBot) checkHealth() *Health {
+	health := &Health{
+		Healthy: true,
+		Checked: time.Now(),
+	}
+
+	walletrpc := mtb.jobWallet("health")
+	start := time.Now()
+	height, err := walletrpc.GetHeight()
+	health.Latency = time.Since(start)
+	if err != nil {
+		health.Healthy = false
+		health.Reason = fmt.Sprintf("wallet RPC unreachable: %s", err)
+		return health
+	}
+	health.WalletHeight = height.Height
+
+	health.Stored, err = walletrpc.lastStore()
+	if err != nil {
+		health.Healthy = false
+		health.Reason = fmt.Sprintf("wallet store failed: %s", err)
+		return health
+	}
+
+	maxlatency := time.Duration(viper.GetInt("HEALTH_MAX_LATENCY")) * time.Millisecond
+	if maxlatency > 0 && health.Latency > maxlatency {
+		health.Healthy = false
+		health.Reason = fmt.Sprintf("wallet RPC too slow: %s", health.Latency)
+	}
+
+	if len(viper.GetString("monero_daemon_url")) == 0 {
+		return health
+	}
+
+	daemonheight, targetheight, synchronized, err := getDaemonInfo()
+	if err != nil {
+		health.Healthy = false
+		health.Reason = fmt.Sprintf("daemon unreachable: %s", err)
+		return health
+	}
+	health.DaemonHeight = daemonheight
+	health.TargetHeight = targetheight
+
+	if !synchronized || targetheight > daemonheight {
+		health.Healthy = false
+		health.Reason = fmt.Sprintf("daemon not synced: %d of %d", daemonheight, targetheight)
+		return health
+	}
+	// the wallet reports the number of blocks it scanned, the daemon the same. allow some lag for new blocks.
+	if daemonheight > health.WalletHeight && daemonheight-health.WalletHeight > uint64(viper.GetInt("HEALTH_MAX_HEIGHT_LAG")) {
+		health.Healthy = false
+		health.Reason = fmt.Sprintf("wallet not synced: %d of %d", health.WalletHeight, daemonheight)
+	}
+
+	return health
+}
+
+func (mtb *MoneroTipBot) isHealthy() bool {
+	healthmutex.Lock()
+	defer healthmutex.Unlock()
+	return mtb.health == nil || mtb.health.Healthy
+}
+
+// checkHealthy returns the friendly HEALTH_UNAVAILABLE_MESSAGE while the wallet is unhealthy
+func (mtb *MoneroTipBot) checkHealthy() error {
+	if !mtb.isHealthy() {
+		return errors.New(viper.GetString("HEALTH_UNAVAILABLE_MESSAGE"))
+	}
+	return nil
+}
+
+func (health *Health) String() string {
+	status := "healthy"
+	if !health.Healthy {
+		status = fmt.Sprintf("UNHEALTHY (%s)", health.Reason)
+	}
+	daemon := "n/a (monero_daemon_url not set)"
+	if health.DaemonHeight > 0 {
+		daemon = fmt.Sprintf("%d", health.DaemonHeight)
+		if health.TargetHeight > 0 {
+			daemon = fmt.Sprintf("%d of %d", health.DaemonHeight, health.TargetHeight)
+		}
+	}
+	stored := "not yet"
+	if !health.Stored.IsZero() {
+		stored = health.Stored.Format(time.RFC1123)
+	}
+	return fmt.Sprintf("Status: %s\nSince: %s\n\nWallet height: %d\nDaemon height: %s\nRPC latency: %s\nWallet stored: %s\nChecked: %s", status, health.Since.Format(time.RFC1123), health.WalletHeight, daemon, health.Latency, stored, health.Checked.Format(time.RFC1123))
+}
+
+// healthScheduler checks the wallet every HEALTH_CHECK_INTERVAL seconds and alerts the admins on every change
+func (mtb *MoneroTipBot) healthScheduler() {
+	for {
+		interval := time.Duration(viper.GetInt("HEALTH_CHECK_INTERVAL")) * time.Second
+		if interval == 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		health := mtb.checkHealth()
+
+		healthmutex.Lock()
+		previous := mtb.health
+		health.Since = health.Checked
+		if previous != nil && previous.Healthy == health.Healthy {
+			health.Since = previous.Since
+		}
+		mtb.health = health
+		healthmutex.Unlock()
+
+		healthy := int64(0)
+		if health.Healthy {
+			healthy = 1
+		}
+		mtb.metricGauge("health.healthy", float64(healthy))
+		mtb.metricTiming("health.rpc_latency", health.Latency)
+		if health.DaemonHeight > health.WalletHeight {
+			mtb.metricGauge("health.height_lag", float64(health.DaemonHeight-health.WalletHeight))
+		} else {
+			mtb.metricGauge("health.height_lag", 0)
+		}
+
+		// the first check only alerts if something is wrong
+		if (previous == nil && !health.Healthy) || (previous != nil && previous.Healthy != health.Healthy) {
+			if health.Healthy {
+				jobLogger("health").Info("Wallet is healthy again")
+				mtb.notifyAdmins("health", fmt.Sprintf("Wallet is healthy again. Transfers are enabled.\n\n%s", health))
+			} else {
+				jobLogger("health").WithField("reason", health.Reason).Warn("Wallet is unhealthy")
+				mtb.notifyAdmins("health", fmt.Sprintf("Wallet is unhealthy. Transfers are disabled until it recovers.\n\n%s", health))
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
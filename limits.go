@@ -0,0 +1,221 @@
+package monerotipbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omani/go-monero-rpc-client/wallet"
+	"github.com/spf13/viper"
+)
+
+const limitsDayFormat = "2006-01-02"
+
+// loadLimits reads all user limits from LIMITS_FILE. A missing file means no limits yet.
+func loadLimits() (map[int64]*Limits, error) {
+	limits := make(map[int64]*Limits)
+
+	file, err := ioutil.ReadFile(viper.GetString("LIMITS_FILE"))
+	if err != nil {
+		return limits, nil
+	}
+
+	var entries []*Limits
+	err = json.Unmarshal(file, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		limits[entry.UserID] = entry
+	}
+
+	return limits, nil
+}
+
+func (mtb *MoneroTipBot) saveLimitsToFile() error {
+	var entries []*Limits
+	for _, entry := range mtb.limits {
+		entries = append(entries, entry)
+	}
+
+	file, err := json.MarshalIndent(entries, "", " ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(viper.GetString("LIMITS_FILE"), file, 0644)
+}
+
+func (mtb *MoneroTipBot) getLimits(userid int64) *Limits {
+	limits, ok := mtb.limits[userid]
+	if !ok {
+		limits = &Limits{UserID: userid}
+		mtb.limits[userid] = limits
+	}
+	return limits
+}
+
+// lowerOf returns the stricter of two caps where 0 means unlimited
+func lowerOf(a, b uint64) uint64 {
+	if a == 0 {
+		return b
+	}
+	if b == 0 || a < b {
+		return a
+	}
+	return b
+}
+
+func (l *Limits) dailyLimit() uint64 {
+	return lowerOf(wallet.Float64ToXMR(viper.GetFloat64("DAILY_SPENDING_LIMIT")), l.DailyLimit)
+}
+
+func (l *Limits) maxTip() uint64 {
+	return lowerOf(wallet.Float64ToXMR(viper.GetFloat64("MAX_TIP_AMOUNT")), l.MaxTip)
+}
+
+func (l *Limits) tipCooldown() time.Duration {
+	cooldown := viper.GetInt("TIP_COOLDOWN")
+	if l.TipCooldown > cooldown {
+		cooldown = l.TipCooldown
+	}
+	return time.Duration(cooldown) * time.Second
+}
+
+func (l *Limits) spentOn(now time.Time) uint64 {
+	if l.Day != now.UTC().Format(limitsDayFormat) {
+		return 0
+	}
+	return l.SpentToday
+}
+
+func nextLimitsReset(now time.Time) time.Time {
+	year, month, day := now.UTC().Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC)
+}
+
+// checkLimits returns an error explaining which limit the outgoing amount would exceed.
+// tip additionally enforces the maximum single tip and the cooldown between tips.
+func (mtb *MoneroTipBot) checkLimits(userid int64, amount uint64, tip bool) error {
+	limits := mtb.getLimits(userid)
+	now := time.Now()
+
+	if tip {
+		maxtip := limits.maxTip()
+		if maxtip > 0 && amount > maxtip {
+			return fmt.Errorf("Maximum amount for a single tip is %f XMR.", wallet.XMRToFloat64(maxtip))
+		}
+		cooldown := limits.tipCooldown()
+		if now.Before(limits.LastTip.Add(cooldown)) {
+			return fmt.Errorf("Please wait %d seconds between tips. You can tip again at %s.", int(cooldown.Seconds()), limits.LastTip.Add(cooldown).UTC().Format(time.RFC1123))
+		}
+	}
+
+	dailylimit := limits.dailyLimit()
+	spent := limits.spentOn(now)
+	if dailylimit > 0 && spent+amount > dailylimit {
+		return fmt.Errorf("Daily limit of %f XMR exceeded (%f XMR spent today). Your limit resets at %s.", wallet.XMRToFloat64(dailylimit), wallet.XMRToFloat64(spent), nextLimitsReset(now).Format(time.RFC1123))
+	}
+
+	return nil
+}
+
+// recordSpending adds amount to the daily usage of the user. tip also starts the tip cooldown.
+func (mtb *MoneroTipBot) recordSpending(userid int64, amount uint64, tip bool) error {
+	limits := mtb.getLimits(userid)
+	now := time.Now()
+
+	today := now.UTC().Format(limitsDayFormat)
+	if limits.Day != today {
+		limits.Day = today
+		limits.SpentToday = 0
+	}
+	limits.SpentToday += amount
+	if tip {
+		limits.LastTip = now
+	}
+
+	return mtb.saveLimitsToFile()
+}
+
+func (mtb *MoneroTipBot) parseCommandLIMITS() error {
+	msg := mtb.newReplyMessage(true)
+
+	limits := mtb.getLimits(int64(mtb.from.ID))
+
+	split := strings.Fields(mtb.message.CommandArguments())
+	if len(split) == 0 {
+		msg.Text = limits.String()
+		return mtb.reply(msg)
+	}
+	if len(split) != 2 {
+		msg.Text = "Please specify the limit and the new value: /limits daily|maxtip|cooldown VALUE"
+		return mtb.reply(msg)
+	}
+
+	switch split[0] {
+	case "daily", "maxtip":
+		value := strings.Replace(split[1], ",", ".", -1)
+		parseamount, err := strconv.ParseFloat(value, 64)
+		if err != nil || parseamount <= 0 {
+			msg.Text = "Could not parse amount."
+			return mtb.reply(msg)
+		}
+		amount := wallet.Float64ToXMR(parseamount)
+
+		current := limits.dailyLimit()
+		if split[0] == "maxtip" {
+			current = limits.maxTip()
+		}
+		if current > 0 && amount > current {
+			msg.Text = fmt.Sprintf("You can only lower your limits. Current limit is %f XMR.", wallet.XMRToFloat64(current))
+			return mtb.reply(msg)
+		}
+
+		if split[0] == "daily" {
+			limits.DailyLimit = amount
+		} else {
+			limits.MaxTip = amount
+		}
+	case "cooldown":
+		seconds, err := strconv.Atoi(split[1])
+		if err != nil || seconds <= 0 {
+			msg.Text = "Could not parse seconds."
+			return mtb.reply(msg)
+		}
+		current := int(limits.tipCooldown().Seconds())
+		if seconds < current {
+			msg.Text = fmt.Sprintf("You can only lower your limits. Current cooldown is %d seconds.", current)
+			return mtb.reply(msg)
+		}
+		limits.TipCooldown = seconds
+	default:
+		msg.Text = "Unknown limit. See /help limits"
+		return mtb.reply(msg)
+	}
+
+	err := mtb.saveLimitsToFile()
+	if err != nil {
+		msg.Text = fmt.Sprintf("Error while saving limits: %s", err)
+		return mtb.reply(msg)
+	}
+	mtb.metricIncr("limits_changed.counter", 1)
+
+	msg.Text = fmt.Sprintf("Limits updated.\n\n%s", limits)
+	return mtb.reply(msg)
+}
+
+func (l *Limits) String() string {
+	format := func(amount uint64) string {
+		if amount == 0 {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%f XMR", wallet.XMRToFloat64(amount))
+	}
+
+	now := time.Now()
+	return fmt.Sprintf("Daily limit: %s\nSpent today: %f XMR\nMax single tip: %s\nSeconds between tips: %d\n\nDaily limit resets at %s.", format(l.dailyLimit()), wallet.XMRToFloat64(l.spentOn(now)), format(l.maxTip()), int(l.tipCooldown().Seconds()), nextLimitsReset(now).Format(time.RFC1123))
+}
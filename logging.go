@@ -0,0 +1,172 @@
+package monerotipbot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/natefinch/lumberjack.v2"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+var (
+	logmutex sync.Mutex
+	// standard addresses are 95, integrated addresses 106 characters of base58
+	addressregexp = regexp.MustCompile(`\b[4589][1-9A-HJ-NP-Za-km-z]{94}(?:[1-9A-HJ-NP-Za-km-z]{11})?\b`)
+	amountregexp  = regexp.MustCompile(`\d+(?:\.\d+)?\s*XMR`)
+)
+
+// redactedfields are the log fields that carry addresses or amounts
+var redactedfields = map[string]bool{
+	"address": true,
+	"amount":  true,
+	"fee":     true,
+	"balance": true,
+}
+
+// redactFormatter removes addresses and amounts from the message and the fields before they are written
+type redactFormatter struct {
+	logrus.Formatter
+}
+
+func redact(text string) string {
+	text = addressregexp.ReplaceAllString(text, "[address]")
+	return amountregexp.ReplaceAllString(text, "[amount] XMR")
+}
+
+func (f *redactFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	redacted := entry.Dup()
+	redacted.Message = redact(entry.Message)
+	redacted.Level = entry.Level
+	redacted.Caller = entry.Caller
+	for key, value := range entry.Data {
+		if redactedfields[key] {
+			redacted.Data[key] = "[redacted]"
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			redacted.Data[key] = redact(v)
+		case error:
+			redacted.Data[key] = redact(v.Error())
+		}
+	}
+	return f.Formatter.Format(redacted)
+}
+
+// setupLogging writes JSON logs to LOGFILE, rotated by size and age, and to stdout if LOG_STDOUT.
+// The standard logger (used by the Telegram API library among others) goes through the same output.
+func setupLogging() error {
+	level, err := logrus.ParseLevel(viper.GetString("LOG_LEVEL"))
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(level)
+
+	var formatter logrus.Formatter = &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+	if viper.GetBool("LOG_REDACT") {
+		formatter = &redactFormatter{Formatter: formatter}
+	}
+	logrus.SetFormatter(formatter)
+
+	var output io.Writer = &lumberjack.Logger{
+		Filename:   viper.GetString("LOGFILE"),
+		MaxSize:    viper.GetInt("LOG_MAX_SIZE"),
+		MaxBackups: viper.GetInt("LOG_MAX_BACKUPS"),
+		MaxAge:     viper.GetInt("LOG_MAX_AGE"),
+		Compress:   viper.GetBool("LOG_COMPRESS"),
+	}
+	if viper.GetBool("LOG_STDOUT") {
+		output = io.MultiWriter(output, os.Stdout)
+	}
+	logrus.SetOutput(output)
+
+	log.SetFlags(0)
+	log.SetOutput(logrus.StandardLogger().WriterLevel(logrus.InfoLevel))
+	return nil
+}
+
+func newCorrelationID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// jobLogger is the logger of background jobs, which don't belong to an update
+func jobLogger(job string) *logrus.Entry {
+	return logrus.WithField("job", job)
+}
+
+// logger returns the logger of the update being processed. Every entry carries its correlation_id.
+// Outside of an update it returns the plain logger.
+func (mtb *MoneroTipBot) logger() *logrus.Entry {
+	logmutex.Lock()
+	defer logmutex.Unlock()
+	if mtb.updatelog == nil {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	return mtb.updatelog
+}
+
+// beginUpdate assigns a correlation ID to update and logs its arrival
+func (mtb *MoneroTipBot) beginUpdate(update tgbotapi.Update) {
+	fields := logrus.Fields{
+		"correlation_id": newCorrelationID(),
+		"update_id":      update.UpdateID,
+	}
+
+	kind := "other"
+	var message *tgbotapi.Message
+	if update.Message != nil {
+		kind = "message"
+		message = update.Message
+		if message.IsCommand() {
+			kind = "command"
+			fields["command"] = strings.ToLower(message.Command())
+		}
+		if message.From != nil {
+			fields["user_id"] = message.From.ID
+		}
+	}
+	if update.CallbackQuery != nil {
+		kind = "callback"
+		message = update.CallbackQuery.Message
+		fields["user_id"] = update.CallbackQuery.From.ID
+		fields["callback"] = strings.SplitN(update.CallbackQuery.Data, "_", 2)[0]
+	}
+	fields["kind"] = kind
+	if message != nil && message.Chat != nil {
+		fields["chat_id"] = message.Chat.ID
+		fields["chat_type"] = message.Chat.Type
+	}
+
+	entry := logrus.WithFields(fields)
+	logmutex.Lock()
+	mtb.updatelog = entry
+	mtb.updatestart = time.Now()
+	logmutex.Unlock()
+
+	entry.Debug("Update received")
+}
+
+// endUpdate logs the end of the update and its duration
+func (mtb *MoneroTipBot) endUpdate() {
+	logmutex.Lock()
+	entry := mtb.updatelog
+	start := mtb.updatestart
+	mtb.updatelog = nil
+	logmutex.Unlock()
+
+	if entry == nil {
+		return
+	}
+	entry.WithField("duration_ms", time.Since(start).Milliseconds()).Debug("Update handled")
+}
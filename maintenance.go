@@ -0,0 +1,126 @@
+package monerotipbot
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+var operatormutex sync.Mutex
+
+// loadOperatorState reads maintenance mode and frozen accounts from OPERATOR_STATE_FILE. A missing file means no maintenance and no freezes.
+func loadOperatorState() (bool, map[uint64]*FrozenAccount, error) {
+	frozenaccounts := make(map[uint64]*FrozenAccount)
+
+	file, err := ioutil.ReadFile(viper.GetString("OPERATOR_STATE_FILE"))
+	if err != nil {
+		return false, frozenaccounts, nil
+	}
+
+	state := &OperatorState{}
+	err = json.Unmarshal(file, state)
+	if err != nil {
+		return false, nil, err
+	}
+	for _, frozen := range state.Frozen {
+		frozenaccounts[frozen.AccountIndex] = frozen
+	}
+
+	return state.Maintenance, frozenaccounts, nil
+}
+
+// saveOperatorStateToFile must be called with operatormutex held
+func (mtb *MoneroTipBot) saveOperatorStateToFile() error {
+	state := &OperatorState{Maintenance: mtb.maintenance}
+	for _, frozen := range mtb.frozenaccounts {
+		state.Frozen = append(state.Frozen, frozen)
+	}
+
+	file, err := json.MarshalIndent(state, "", " ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(viper.GetString("OPERATOR_STATE_FILE"), file, 0644)
+}
+
+func (mtb *MoneroTipBot) isMaintenance() bool {
+	operatormutex.Lock()
+	defer operatormutex.Unlock()
+	return mtb.maintenance
+}
+
+func (mtb *MoneroTipBot) setMaintenance(enabled bool) error {
+	operatormutex.Lock()
+	defer operatormutex.Unlock()
+	mtb.maintenance = enabled
+	return mtb.saveOperatorStateToFile()
+}
+
+// frozenAccount returns the freeze of accountindex, or nil if the account is not frozen
+func (mtb *MoneroTipBot) frozenAccount(accountindex uint64) *FrozenAccount {
+	operatormutex.Lock()
+	defer operatormutex.Unlock()
+	return mtb.frozenaccounts[accountindex]
+}
+
+func (mtb *MoneroTipBot) frozenAccountCount() int {
+	operatormutex.Lock()
+	defer operatormutex.Unlock()
+	return len(mtb.frozenaccounts)
+}
+
+func (mtb *MoneroTipBot) freezeAccount(frozen *FrozenAccount) error {
+	operatormutex.Lock()
+	defer operatormutex.Unlock()
+	mtb.frozenaccounts[frozen.AccountIndex] = frozen
+	return mtb.saveOperatorStateToFile()
+}
+
+func (mtb *MoneroTipBot) unfreezeAccount(accountindex uint64) error {
+	operatormutex.Lock()
+	defer operatormutex.Unlock()
+	delete(mtb.frozenaccounts, accountindex)
+	return mtb.saveOperatorStateToFile()
+}
+
+// checkTransfer returns an error if funds of accountindex must not be moved right now.
+// every path that calls Transfer or SweepAll for a user has to pass it.
+func (mtb *MoneroTipBot) checkTransfer(accountindex uint64) error {
+	err := mtb.checkHealthy()
+	if err != nil {
+		return err
+	}
+	if mtb.isMaintenance() {
+		return errors.New(viper.GetString("MAINTENANCE_MESSAGE"))
+	}
+	if mtb.frozenAccount(accountindex) != nil {
+		return errors.New(viper.GetString("FROZEN_MESSAGE"))
+	}
+	return nil
+}
+
+// checkOperational runs checkTransfer for the account of the current user
+func (mtb *MoneroTipBot) checkOperational() error {
+	// don't even ask the wallet for the account while it is unhealthy
+	err := mtb.checkHealthy()
+	if err != nil {
+		return err
+	}
+	if mtb.isMaintenance() {
+		return errors.New(viper.GetString("MAINTENANCE_MESSAGE"))
+	}
+
+	useraccount, err := mtb.getUserAccount()
+	if err != nil {
+		return err
+	}
+	if useraccount == nil {
+		return nil
+	}
+
+	return mtb.checkTransfer(useraccount.AccountIndex)
+}
@@ -0,0 +1,296 @@
+package monerotipbot
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omani/go-monero-rpc-client/wallet"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	statsd "github.com/smira/go-statsd"
+	"github.com/spf13/viper"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// metricLabel is a dimension of a metric, e.g. the command or the wallet RPC method
+type metricLabel struct {
+	name  string
+	value string
+}
+
+func label(name, value string) metricLabel {
+	return metricLabel{name: name, value: value}
+}
+
+// Metrics feeds statsd (if USE_STATSD) and Prometheus (if METRICS_LISTEN) from the same call sites.
+//
+// Metric names are statsd stat names. Every "*" is replaced by the value of the next label for statsd,
+// e.g. "commands.*.counter" with label("command", "TIP") is "commands.TIP.counter". Dots in a value become "_".
+// For Prometheus the "*" and "counter" parts are dropped and the labels kept:
+// monerotipbot_commands_total{command="TIP"}.
+type Metrics struct {
+	statsdclient *statsd.Client
+
+	registry   *prometheus.Registry
+	server     *http.Server
+	mutex      sync.Mutex
+	counters   map[string]*prometheus.CounterVec
+	gauges     map[string]*prometheus.GaugeVec
+	histograms map[string]*prometheus.HistogramVec
+}
+
+func newMetrics() *Metrics {
+	metrics := &Metrics{}
+
+	if viper.GetBool("USE_STATSD") {
+		// initiate statsd client
+		metrics.statsdclient = statsd.NewClient(viper.GetString("statsd_address"), statsd.MetricPrefix(viper.GetString("statsd_prefix")), statsd.SendLoopCount(10), statsd.MaxPacketSize(100000))
+	}
+
+	if len(viper.GetString("METRICS_LISTEN")) > 0 {
+		metrics.registry = prometheus.NewRegistry()
+		metrics.registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		metrics.counters = make(map[string]*prometheus.CounterVec)
+		metrics.gauges = make(map[string]*prometheus.GaugeVec)
+		metrics.histograms = make(map[string]*prometheus.HistogramVec)
+	}
+
+	return metrics
+}
+
+// statsdReplacer replaces what would split a label value into several graphite path segments or break the statsd line
+var statsdReplacer = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", " ", "_", "/", "_")
+
+// statsdName puts the label values into stat. Prometheus gets the raw values.
+func statsdName(stat string, labels []metricLabel) string {
+	for _, l := range labels {
+		stat = strings.Replace(stat, "*", statsdReplacer.Replace(l.value), 1)
+	}
+	return stat
+}
+
+func prometheusName(stat string, suffix string) string {
+	var parts []string
+	for _, part := range strings.Split(stat, ".") {
+		if part != "*" && part != "counter" {
+			parts = append(parts, part)
+		}
+	}
+	return "monerotipbot_" + strings.Join(parts, "_") + suffix
+}
+
+func labelNames(labels []metricLabel) []string {
+	names := make([]string, len(labels))
+	for i, l := range labels {
+		names[i] = l.name
+	}
+	return names
+}
+
+func labelValues(labels []metricLabel) []string {
+	values := make([]string, len(labels))
+	for i, l := range labels {
+		values[i] = l.value
+	}
+	return values
+}
+
+// the metric vectors are created on first use, since the call sites define them
+
+func (m *Metrics) counter(stat string, labels []metricLabel) prometheus.Counter {
+	name := prometheusName(stat, "_total")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	vec, ok := m.counters[name]
+	if !ok {
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: stat}, labelNames(labels))
+		m.registry.MustRegister(vec)
+		m.counters[name] = vec
+	}
+	return vec.WithLabelValues(labelValues(labels)...)
+}
+
+func (m *Metrics) gauge(stat string, labels []metricLabel) prometheus.Gauge {
+	name := prometheusName(stat, "")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	vec, ok := m.gauges[name]
+	if !ok {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: stat}, labelNames(labels))
+		m.registry.MustRegister(vec)
+		m.gauges[name] = vec
+	}
+	return vec.WithLabelValues(labelValues(labels)...)
+}
+
+func (m *Metrics) histogram(stat string, labels []metricLabel) prometheus.Observer {
+	name := prometheusName(stat, "_seconds")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	vec, ok := m.histograms[name]
+	if !ok {
+		// 5ms up to ~80s. transfers can take a while.
+		vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: stat, Buckets: prometheus.ExponentialBuckets(0.005, 2, 15)}, labelNames(labels))
+		m.registry.MustRegister(vec)
+		m.histograms[name] = vec
+	}
+	return vec.WithLabelValues(labelValues(labels)...)
+}
+
+func (m *Metrics) Incr(stat string, count int64, labels ...metricLabel) {
+	if m.statsdclient != nil {
+		m.statsdclient.Incr(statsdName(stat, labels), count)
+	}
+	if m.registry != nil {
+		m.counter(stat, labels).Add(float64(count))
+	}
+}
+
+func (m *Metrics) Gauge(stat string, value float64, labels ...metricLabel) {
+	if m.statsdclient != nil {
+		m.statsdclient.FGauge(statsdName(stat, labels), value)
+	}
+	if m.registry != nil {
+		m.gauge(stat, labels).Set(value)
+	}
+}
+
+func (m *Metrics) Timing(stat string, delta time.Duration, labels ...metricLabel) {
+	if m.statsdclient != nil {
+		m.statsdclient.PrecisionTiming(statsdName(stat, labels), delta)
+	}
+	if m.registry != nil {
+		m.histogram(stat, labels).Observe(delta.Seconds())
+	}
+}
+
+// listen serves the Prometheus metrics on METRICS_LISTEN at /metrics
+func (m *Metrics) listen() error {
+	if m.registry == nil {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	m.server = &http.Server{
+		Addr:              viper.GetString("METRICS_LISTEN"),
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	listener, err := net.Listen("tcp", m.server.Addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		err := m.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Error("Error while serving metrics")
+		}
+	}()
+
+	logrus.WithField("listen", m.server.Addr).Info("Serving metrics on /metrics")
+	return nil
+}
+
+func (m *Metrics) Close() {
+	if m.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		m.server.Shutdown(ctx)
+	}
+	if m.statsdclient != nil {
+		m.statsdclient.Close()
+	}
+}
+
+func (mtb *MoneroTipBot) metricIncr(stat string, count int64, labels ...metricLabel) {
+	mtb.metrics.Incr(stat, count, labels...)
+}
+
+func (mtb *MoneroTipBot) metricGauge(stat string, value float64, labels ...metricLabel) {
+	mtb.metrics.Gauge(stat, value, labels...)
+}
+
+func (mtb *MoneroTipBot) metricTiming(stat string, delta time.Duration, labels ...metricLabel) {
+	mtb.metrics.Timing(stat, delta, labels...)
+}
+
+// balancebuckets are the upper bounds in XMR of the account balance distribution
+var balancebuckets = []float64{0, 0.01, 0.1, 1, 10, 100}
+
+// accountMetrics gauges the number of user accounts, the total balance and the distribution of the balances.
+// With METRICS_PRIVACY turned off it also gauges the username, account index and balance of every user,
+// which sends the identity and balance of every user to the metrics backends.
+func (mtb *MoneroTipBot) accountMetrics(accounts *wallet.ResponseGetAccounts) {
+	mtb.metricGauge("user_accounts.counter", float64(len(accounts.SubaddressAccounts)))
+	mtb.metricGauge("total_balance.counter", wallet.XMRToFloat64(accounts.TotalBalance))
+	mtb.metricGauge("total_unlocked_balance.counter", wallet.XMRToFloat64(accounts.TotalUnlockedBalance))
+
+	counts := make([]int, len(balancebuckets)+1)
+	for _, account := range accounts.SubaddressAccounts {
+		split := strings.Split(account.Label, "@")
+		if len(split) != 2 {
+			continue
+		}
+		userid, err := strconv.ParseInt(split[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		balance := wallet.XMRToFloat64(account.Balance)
+		bucket := sort.SearchFloat64s(balancebuckets, balance)
+		counts[bucket]++
+
+		if !viper.GetBool("METRICS_PRIVACY") {
+			mtb.metricGauge("account_labels_usernames.*", float64(userid), label("username", split[0]))
+			mtb.metricGauge("account_labels.*", float64(account.AccountIndex), label("userid", strconv.FormatInt(userid, 10)))
+			mtb.metricGauge("account_balance_per_label.*", balance, label("userid", strconv.FormatInt(userid, 10)))
+		}
+	}
+
+	// cumulative like a prometheus histogram: accounts with a balance of at most le XMR
+	total := 0
+	for i, count := range counts {
+		total += count
+		le := "inf"
+		if i < len(balancebuckets) {
+			le = strconv.FormatFloat(balancebuckets[i], 'f', -1, 64)
+		}
+		mtb.metricGauge("accounts_by_balance.*", float64(total), label("le", le))
+	}
+}
+
+// send queues c for Telegram in the outbox, see Outbox. It doesn't wait for the delivery.
+func (mtb *MoneroTipBot) send(c tgbotapi.Chattable) {
+	mtb.outbox.send(c, priorityChatter, nil)
+}
+
+// sendReceipt queues c before the chatter waiting for other chats
+func (mtb *MoneroTipBot) sendReceipt(c tgbotapi.Chattable) {
+	mtb.outbox.send(c, priorityReceipt, nil)
+}
+
+// sendWait queues c and waits until it's sent. Only for the messages the bot has to know the ID of, like giveaways,
+// and for background jobs. It goes before the chatter for other chats to keep the wait short.
+func (mtb *MoneroTipBot) sendWait(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	result := make(chan tgbotapi.Message, 1)
+	var err error
+	mtb.outbox.send(c, priorityReceipt, func(message tgbotapi.Message, senderr error) {
+		err = senderr
+		result <- message
+	})
+	message := <-result
+	return message, err
+}
@@ -0,0 +1,288 @@
+package monerotipbot
+
+import (
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const (
+	// priorityChatter is everything that isn't a receipt: usage hints, errors, broadcasts, reports
+	priorityChatter = iota
+	// priorityReceipt are the confirmations of transfers. They are sent before the chatter waiting for other chats.
+	priorityReceipt
+)
+
+// outboxItem is a message waiting in the outbox
+type outboxItem struct {
+	c        tgbotapi.Chattable
+	chatid   int64
+	kind     string
+	priority int
+	seq      uint64
+	// notbefore is set after Telegram told us to retry after a while
+	notbefore time.Time
+	attempts  int
+	// done is called with the result once the message is sent or failed for good. nil if nobody cares.
+	done func(message tgbotapi.Message, err error)
+}
+
+// Outbox sends everything the bot sends to Telegram. It keeps the limits of Telegram: OUTBOX_GLOBAL_PER_SECOND
+// messages per second in total, one message per OUTBOX_CHAT_INTERVAL to the same user and one per
+// OUTBOX_GROUP_INTERVAL to the same group. Messages Telegram refuses with 429 are retried after retry_after,
+// up to OUTBOX_RETRIES times. The messages to a chat keep their order. Among the chats, receipts go first.
+type Outbox struct {
+	bot     *tgbotapi.BotAPI
+	metrics *Metrics
+
+	mutex    sync.Mutex
+	items    []*outboxItem
+	seq      uint64
+	nextchat map[int64]time.Time
+	// busy are the chats with a message in flight. The next one waits for its outcome, a 429 included.
+	busy    map[int64]bool
+	next    time.Time
+	sending int
+	wake    chan struct{}
+}
+
+func newOutbox(bot *tgbotapi.BotAPI, metrics *Metrics) *Outbox {
+	outbox := &Outbox{
+		bot:      bot,
+		metrics:  metrics,
+		nextchat: make(map[int64]time.Time),
+		busy:     make(map[int64]bool),
+		wake:     make(chan struct{}, 1),
+	}
+	go outbox.run()
+	return outbox
+}
+
+// chattableChat returns the chat and the kind of c
+func chattableChat(c tgbotapi.Chattable) (int64, string) {
+	switch v := c.(type) {
+	case tgbotapi.MessageConfig:
+		return v.ChatID, "message"
+	case tgbotapi.EditMessageTextConfig:
+		return v.ChatID, "edit"
+	case tgbotapi.PhotoConfig:
+		return v.ChatID, "photo"
+	case tgbotapi.DocumentConfig:
+		return v.ChatID, "document"
+	}
+	return 0, "other"
+}
+
+// send queues c and returns right away. done, if not nil, is called with the result once c is sent or failed
+// for good. It runs on a goroutine of the outbox, not on the dispatcher.
+func (o *Outbox) send(c tgbotapi.Chattable, priority int, done func(message tgbotapi.Message, err error)) {
+	chatid, kind := chattableChat(c)
+	item := &outboxItem{
+		c:        c,
+		chatid:   chatid,
+		kind:     kind,
+		priority: priority,
+		done:     done,
+	}
+
+	o.mutex.Lock()
+	o.seq++
+	item.seq = o.seq
+	o.items = append(o.items, item)
+	o.gauge()
+	o.mutex.Unlock()
+	o.notify()
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// gauge must be called with the mutex held
+func (o *Outbox) gauge() {
+	o.metrics.Gauge("outbox.pending", float64(len(o.items)+o.sending))
+}
+
+// chatInterval is the minimum time between two messages to chatid. Groups and channels have negative IDs.
+func chatInterval(chatid int64) time.Duration {
+	if chatid < 0 {
+		return time.Duration(viper.GetInt("OUTBOX_GROUP_INTERVAL")) * time.Millisecond
+	}
+	return time.Duration(viper.GetInt("OUTBOX_CHAT_INTERVAL")) * time.Millisecond
+}
+
+// pick removes and returns the next item that may be sent now. Otherwise it returns the time to look again,
+// zero if the outbox is empty. Must be called with the mutex held.
+func (o *Outbox) pick(now time.Time) (*outboxItem, time.Time) {
+	if len(o.items) == 0 {
+		return nil, time.Time{}
+	}
+	if now.Before(o.next) {
+		return nil, o.next
+	}
+
+	// only the oldest item of a chat may go, so the order within a chat is kept. retried items are still the oldest.
+	heads := make(map[int64]int)
+	for i, item := range o.items {
+		if head, ok := heads[item.chatid]; !ok || item.seq < o.items[head].seq {
+			heads[item.chatid] = i
+		}
+	}
+
+	best := -1
+	var wait time.Time
+	for _, i := range heads {
+		item := o.items[i]
+		if o.busy[item.chatid] {
+			continue
+		}
+		ready := o.nextchat[item.chatid]
+		if item.notbefore.After(ready) {
+			ready = item.notbefore
+		}
+		if now.Before(ready) {
+			if wait.IsZero() || ready.Before(wait) {
+				wait = ready
+			}
+			continue
+		}
+		// priority only decides between chats
+		if best == -1 || item.priority > o.items[best].priority || (item.priority == o.items[best].priority && item.seq < o.items[best].seq) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil, wait
+	}
+
+	item := o.items[best]
+	o.items = append(o.items[:best], o.items[best+1:]...)
+	o.busy[item.chatid] = true
+	o.nextchat[item.chatid] = now.Add(chatInterval(item.chatid))
+	if persecond := viper.GetInt("OUTBOX_GLOBAL_PER_SECOND"); persecond > 0 {
+		o.next = now.Add(time.Second / time.Duration(persecond))
+	}
+	return item, time.Time{}
+}
+
+// run hands the items to Telegram as fast as the limits allow. Sending is done concurrently, so slow requests
+// don't hold up the rest.
+func (o *Outbox) run() {
+	for {
+		o.mutex.Lock()
+		now := time.Now()
+		item, wait := o.pick(now)
+		if item != nil {
+			o.sending++
+		}
+		o.forget(now)
+		o.mutex.Unlock()
+
+		if item != nil {
+			go o.deliver(item)
+			continue
+		}
+
+		if wait.IsZero() {
+			<-o.wake
+			continue
+		}
+		timer := time.NewTimer(wait.Sub(now))
+		select {
+		case <-o.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// forget removes the chats that can be sent to right away, so nextchat doesn't grow forever.
+// Must be called with the mutex held.
+func (o *Outbox) forget(now time.Time) {
+	if len(o.nextchat) < 1000 {
+		return
+	}
+	for chatid, next := range o.nextchat {
+		if now.After(next) {
+			delete(o.nextchat, chatid)
+		}
+	}
+}
+
+func (o *Outbox) deliver(item *outboxItem) {
+	item.attempts++
+	message, err := o.bot.Send(item.c)
+
+	o.mutex.Lock()
+	o.sending--
+	delete(o.busy, item.chatid)
+	if apierr, ok := err.(tgbotapi.Error); ok && apierr.RetryAfter > 0 && item.attempts <= viper.GetInt("OUTBOX_RETRIES") {
+		// flood control. nothing goes to this chat until retry_after is over.
+		retry := time.Now().Add(time.Duration(apierr.RetryAfter) * time.Second)
+		item.notbefore = retry
+		if retry.After(o.nextchat[item.chatid]) {
+			o.nextchat[item.chatid] = retry
+		}
+		o.items = append(o.items, item)
+		o.gauge()
+		o.mutex.Unlock()
+
+		o.metrics.Incr("telegram.retries.*.counter", 1, label("kind", item.kind))
+		logrus.WithFields(logrus.Fields{"chat_id": item.chatid, "kind": item.kind, "retry_after": apierr.RetryAfter}).Warn("Telegram flood control. Retrying later")
+		o.notify()
+		return
+	}
+	o.gauge()
+	o.mutex.Unlock()
+	// the next message to the chat may go
+	o.notify()
+
+	if err != nil {
+		o.deadLetter(item, err)
+	}
+	if item.done != nil {
+		item.done(message, err)
+	}
+}
+
+// deadLetter logs a message that couldn't be delivered, so it doesn't vanish silently. The text is not logged,
+// it may hold secrets like the TOTP secret of /security totp.
+func (o *Outbox) deadLetter(item *outboxItem, err error) {
+	o.metrics.Incr("telegram.send_failures.*.counter", 1, label("kind", item.kind))
+
+	entry := logrus.WithError(err).WithFields(logrus.Fields{
+		"dead_letter": true,
+		"chat_id":     item.chatid,
+		"kind":        item.kind,
+		"attempts":    item.attempts,
+	})
+	switch v := item.c.(type) {
+	case tgbotapi.MessageConfig:
+		entry = entry.WithField("length", utf8.RuneCountInString(v.Text))
+	case tgbotapi.EditMessageTextConfig:
+		entry = entry.WithField("length", utf8.RuneCountInString(v.Text))
+	}
+	entry.Warn("Message not delivered")
+}
+
+// drain waits until the outbox is empty or timeout is over
+func (o *Outbox) drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		o.mutex.Lock()
+		pending := len(o.items) + o.sending
+		o.mutex.Unlock()
+		if pending == 0 {
+			return true
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package monerotipbot
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/omani/go-monero-rpc-client/wallet"
+)
+
+func (mtb *MoneroTipBot) parseCommandPROOF() error {
+	msg := mtb.newReplyMessage(true)
+
+	split := strings.SplitN(strings.TrimSpace(mtb.message.CommandArguments()), " ", 3)
+	if len(split[0]) == 0 {
+		msg.Text = "Please specify the transaction id (with optional address and message): /proof TXID ADDRESS yourmessage goes here"
+		return mtb.reply(msg)
+	}
+	txid := split[0]
+
+	var address, message string
+	if len(split) > 1 {
+		address = split[1]
+	}
+	if len(split) > 2 {
+		message = split[2]
+	}
+
+	useraccount, err := mtb.getUserAccount()
+	if err != nil {
+		return err
+	}
+
+	transfer, err := mtb.walletrpc.GetTransferByTxID(&wallet.RequestGetTransferByTxID{
+		TxID:         txid,
+		AccountIndex: useraccount.AccountIndex,
+	})
+	if err != nil {
+		msg.Text = "Transaction not found."
+		return mtb.reply(msg)
+	}
+	// only outgoing transfers of the user's own account can be proven
+	if transfer.Transfer.SubaddrIndex.Major != useraccount.AccountIndex || (transfer.Transfer.Type != "out" && transfer.Transfer.Type != "pending") {
+		mtb.metricIncr("proof_refused.counter", 1)
+		msg.Text = "This transaction was not sent from your account."
+		return mtb.reply(msg)
+	}
+
+	if len(address) == 0 {
+		if len(transfer.Transfer.Destinations) != 1 {
+			msg.Text = "Please specify the recipient address: /proof TXID ADDRESS"
+			return mtb.reply(msg)
+		}
+		address = transfer.Transfer.Destinations[0].Address
+	}
+
+	proof, err := mtb.walletrpc.GetTxProof(&wallet.RequestGetTxProof{
+		TxID:    txid,
+		Address: address,
+		Message: message,
+	})
+	if err != nil {
+		msg.Text = fmt.Sprintf("Error while creating proof: %s", err)
+		return mtb.reply(msg)
+	}
+
+	txkey, err := mtb.walletrpc.GetTxKey(&wallet.RequestGetTxKey{TxID: txid})
+	if err != nil {
+		msg.Text = fmt.Sprintf("Error while retrieving tx key: %s", err)
+		return mtb.reply(msg)
+	}
+	mtb.metricIncr("proof_created.counter", 1)
+
+	msg.Text = fmt.Sprintf("Proof for transaction %s to address %s.\n\nAmount: %f\n\nHand the following to the recipient. It can be verified with /checkproof or the check_tx_proof command of any monero wallet.", txid, address, wallet.XMRToFloat64(transfer.Transfer.Amount))
+	mtb.reply(msg)
+	msg.Text = fmt.Sprintf("Signature:\n%s", proof.Signature)
+	mtb.reply(msg)
+	msg.Text = fmt.Sprintf("TxKey:\n%s", txkey.TxKey)
+	return mtb.reply(msg)
+}
+
+func (mtb *MoneroTipBot) parseCommandCHECKPROOF() error {
+	msg := mtb.newReplyMessage(true)
+
+	split := strings.SplitN(strings.TrimSpace(mtb.message.CommandArguments()), " ", 4)
+	if len(split) < 3 {
+		msg.Text = "Please specify transaction id, address and signature (with optional message): /checkproof TXID ADDRESS SIGNATURE yourmessage goes here"
+		return mtb.reply(msg)
+	}
+
+	var message string
+	if len(split) > 3 {
+		message = split[3]
+	}
+
+	resp, err := mtb.walletrpc.CheckTxProof(&wallet.RequestCheckTxProof{
+		TxID:      split[0],
+		Address:   split[1],
+		Signature: split[2],
+		Message:   message,
+	})
+	if err != nil {
+		msg.Text = fmt.Sprintf("Error while checking proof: %s", err)
+		return mtb.reply(msg)
+	}
+	mtb.metricIncr("proof_checked.counter", 1)
+
+	if !resp.Good {
+		msg.Text = "Proof is NOT valid."
+		return mtb.reply(msg)
+	}
+
+	status := fmt.Sprintf("%d confirmations", resp.Confirmations)
+	if resp.InPool {
+		status = "in pool"
+	}
+	msg.Text = fmt.Sprintf("Proof is valid.\n\nReceived: %f XMR\nStatus: %s", wallet.XMRToFloat64(resp.Received), status)
+	return mtb.reply(msg)
+}
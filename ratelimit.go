@@ -0,0 +1,164 @@
+package monerotipbot
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var ratelimitmutex sync.Mutex
+
+const (
+	// requestCheap are requests that only read, like /balance
+	requestCheap = "cheap"
+	// requestFinancial are requests that move funds, like /tip
+	requestFinancial = "financial"
+)
+
+// financialcommands are the commands with the smaller budget
+var financialcommands = map[string]bool{
+	COMMANDS[TIP]:      true,
+	COMMANDS[SEND]:     true,
+	COMMANDS[GIVEAWAY]: true,
+	COMMANDS[WITHDRAW]: true,
+}
+
+// financialcallbacks are the prefixes of the callbacks with the smaller budget
+var financialcallbacks = []string{"giveaway_claim", "qrcode_tx_send"}
+
+// tokenBucket holds up to burst tokens and refills perminute tokens per minute. Every request takes one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// notified is set once the user got the throttle notice, until a request passes again
+	notified bool
+}
+
+// rateLimit returns the burst and refill rate of scope ("user" or "chat") and class from the config.
+// A burst of 0 disables the limit.
+func rateLimit(scope, class string) (float64, float64) {
+	key := fmt.Sprintf("RATE_LIMIT_%s_%s", scope, strings.ToUpper(class))
+	return viper.GetFloat64(key + "_BURST"), viper.GetFloat64(key + "_PER_MINUTE")
+}
+
+// refill must be called with ratelimitmutex held
+func (bucket *tokenBucket) refill(now time.Time, burst, perminute float64) {
+	bucket.tokens += now.Sub(bucket.last).Minutes() * perminute
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+}
+
+// bucket returns the bucket of key and creates a full one on first use. Must be called with ratelimitmutex held.
+func (mtb *MoneroTipBot) bucket(key string, burst float64, now time.Time) *tokenBucket {
+	bucket, ok := mtb.ratelimits[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		mtb.ratelimits[key] = bucket
+	}
+	return bucket
+}
+
+// pruneBuckets forgets the buckets that are full again, so the map doesn't grow with every user ever seen.
+// Must be called with ratelimitmutex held.
+func (mtb *MoneroTipBot) pruneBuckets(now time.Time) {
+	if now.Sub(mtb.ratelimitpruned) < time.Minute*10 {
+		return
+	}
+	for key, bucket := range mtb.ratelimits {
+		// a bucket idle for an hour is full with any sensible config
+		if now.Sub(bucket.last) > time.Hour {
+			delete(mtb.ratelimits, key)
+		}
+	}
+	mtb.ratelimitpruned = now
+}
+
+// requestClass tells cheap from financial requests
+func (mtb *MoneroTipBot) requestClass() string {
+	if mtb.callback != nil {
+		for _, prefix := range financialcallbacks {
+			if strings.HasPrefix(mtb.callback.Data, prefix) {
+				return requestFinancial
+			}
+		}
+		return requestCheap
+	}
+	if mtb.message.IsCommand() && financialcommands[mtb.message.Command()] {
+		return requestFinancial
+	}
+	return requestCheap
+}
+
+// isThrottled takes a token from the bucket of the user and, in groups, of the chat.
+// If one of them is empty the request is throttled and nothing is taken. The user gets a notice on the first
+// throttled request. Later ones are dropped silently until a request passes again.
+func (mtb *MoneroTipBot) isThrottled() bool {
+	// operators must not be locked out during an incident
+	if mtb.isAdmin() {
+		return false
+	}
+
+	class := mtb.requestClass()
+	now := time.Now()
+
+	type limit struct {
+		scope  string
+		bucket *tokenBucket
+	}
+	var limits []limit
+
+	ratelimitmutex.Lock()
+	mtb.pruneBuckets(now)
+	burst, perminute := rateLimit("USER", class)
+	if burst > 0 {
+		bucket := mtb.bucket(fmt.Sprintf("user:%d:%s", mtb.from.ID, class), burst, now)
+		bucket.refill(now, burst, perminute)
+		limits = append(limits, limit{scope: "user", bucket: bucket})
+	}
+	if mtb.message != nil && mtb.message.Chat != nil && !mtb.message.Chat.IsPrivate() {
+		burst, perminute := rateLimit("CHAT", class)
+		if burst > 0 {
+			bucket := mtb.bucket(fmt.Sprintf("chat:%d:%s", mtb.message.Chat.ID, class), burst, now)
+			bucket.refill(now, burst, perminute)
+			limits = append(limits, limit{scope: "chat", bucket: bucket})
+		}
+	}
+
+	var throttled *limit
+	for i := range limits {
+		if limits[i].bucket.tokens < 1 {
+			throttled = &limits[i]
+			break
+		}
+	}
+	if throttled == nil {
+		for _, l := range limits {
+			l.bucket.tokens--
+			l.bucket.notified = false
+		}
+		ratelimitmutex.Unlock()
+		return false
+	}
+	notify := !throttled.bucket.notified
+	throttled.bucket.notified = true
+	ratelimitmutex.Unlock()
+
+	mtb.metricIncr("ratelimit.throttled.*.*.counter", 1, label("scope", throttled.scope), label("class", class))
+	mtb.logger().WithField("scope", throttled.scope).Info("Request throttled")
+
+	if notify {
+		msg := mtb.newReplyMessage(true)
+		if throttled.scope == "chat" {
+			msg.Text = "There are too many requests in this group right now. Please try again in a minute."
+		} else {
+			msg.Text = "You are sending too many requests. Please slow down and try again in a minute."
+		}
+		mtb.reply(msg)
+	}
+	return true
+}
@@ -0,0 +1,214 @@
+package monerotipbot
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omani/go-monero-rpc-client/wallet"
+	"github.com/spf13/viper"
+)
+
+// reconcile walks all wallet accounts and checks that every user account maps to exactly one telegram user
+// and that the pooled balances match the audit log
+func (mtb *MoneroTipBot) reconcile() (*Reconciliation, error) {
+	accounts, err := mtb.jobWallet("reconcile").GetAccounts(&wallet.RequestGetAccounts{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Reconciliation{
+		Time:               time.Now(),
+		Accounts:           len(accounts.SubaddressAccounts),
+		DuplicateUserIDs:   make(map[int64][]uint64),
+		DuplicateUsernames: make(map[string][]uint64),
+	}
+
+	userids := make(map[int64][]uint64)
+	usernames := make(map[string][]uint64)
+	knownusernames := make(map[string]bool)
+
+	for _, address := range accounts.SubaddressAccounts {
+		account := &Account{
+			AccountIndex:    address.AccountIndex,
+			Balance:         address.Balance,
+			BaseAddress:     address.BaseAddress,
+			Label:           address.Label,
+			Tag:             address.Tag,
+			UnlockedBalance: address.UnlockedBalance,
+		}
+
+		// the primary account belongs to the bot operator
+		if address.AccountIndex == 0 {
+			continue
+		}
+
+		split := strings.Split(address.Label, "@")
+		if len(split) != 2 || len(split[0]) == 0 {
+			result.InvalidLabels = append(result.InvalidLabels, account)
+			continue
+		}
+		userid, err := strconv.ParseInt(split[1], 10, 64)
+		if err != nil {
+			result.InvalidLabels = append(result.InvalidLabels, account)
+			continue
+		}
+
+		username := strings.ToLower(split[0])
+		usernames[username] = append(usernames[username], address.AccountIndex)
+
+		if userid == 0 {
+			result.Unclaimed = append(result.Unclaimed, account)
+			continue
+		}
+		result.UserAccounts++
+		knownusernames[username] = true
+		userids[userid] = append(userids[userid], address.AccountIndex)
+	}
+
+	for userid, indices := range userids {
+		if len(indices) > 1 {
+			result.DuplicateUserIDs[userid] = indices
+		}
+	}
+	for username, indices := range usernames {
+		if len(indices) > 1 {
+			result.DuplicateUsernames[username] = indices
+		}
+	}
+	// a username@0 account of a known user can never be reached by that user. the first matching label wins.
+	for _, account := range result.Unclaimed {
+		if knownusernames[strings.ToLower(strings.Split(account.Label, "@")[0])] {
+			result.Orphans = append(result.Orphans, account)
+		}
+	}
+
+	result.PoolMismatches, err = mtb.reconcilePool()
+	if err != nil {
+		return nil, err
+	}
+
+	mtb.metricGauge("reconciliation_discrepancies.counter", float64(result.Discrepancies()))
+
+	return result, nil
+}
+
+// reconcilePool replays the pool credits and debits of the audit log and compares them with the pooled balance of every account
+func (mtb *MoneroTipBot) reconcilePool() ([]*PoolMismatch, error) {
+	// no pool booking may happen in between. creditPool and debitPool write the ledger and the audit log under coldmutex.
+	coldmutex.Lock()
+	defer coldmutex.Unlock()
+	auditmutex.Lock()
+	defer auditmutex.Unlock()
+
+	audited := make(map[uint64]uint64)
+	err := readAuditLog(func(line int, entry *AuditEntry) error {
+		if entry.Outcome != auditOutcomeOK {
+			return nil
+		}
+		switch entry.Action {
+		case "pool_credit":
+			audited[entry.AccountIndex] += entry.Amount + entry.Fee
+		case "pool_debit":
+			// like debitPool, the fee is on the operator
+			if entry.Amount >= audited[entry.AccountIndex] {
+				delete(audited, entry.AccountIndex)
+			} else {
+				audited[entry.AccountIndex] -= entry.Amount
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []*PoolMismatch
+	for index, amount := range mtb.coldallocations {
+		if audited[index] != amount {
+			mismatches = append(mismatches, &PoolMismatch{AccountIndex: index, Ledger: amount, Audited: audited[index]})
+		}
+	}
+	for index, amount := range audited {
+		if _, ok := mtb.coldallocations[index]; !ok {
+			mismatches = append(mismatches, &PoolMismatch{AccountIndex: index, Audited: amount})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].AccountIndex < mismatches[j].AccountIndex
+	})
+	return mismatches, nil
+}
+
+// Discrepancies counts everything that needs the attention of an admin
+func (r *Reconciliation) Discrepancies() int {
+	return len(r.DuplicateUserIDs) + len(r.DuplicateUsernames) + len(r.Orphans) + len(r.InvalidLabels) + len(r.PoolMismatches)
+}
+
+func (r *Reconciliation) String() string {
+	out := fmt.Sprintf("Reconciliation %s\n\nAccounts: %d\nUser accounts: %d\nUnclaimed (username@0): %d\nDiscrepancies: %d", r.Time.Format(time.RFC1123), r.Accounts, r.UserAccounts, len(r.Unclaimed), r.Discrepancies())
+
+	for _, mismatch := range r.PoolMismatches {
+		out = fmt.Sprintf("%s\n\nPooled balance of account #%d: %f XMR, audit log says %f XMR", out, mismatch.AccountIndex, wallet.XMRToFloat64(mismatch.Ledger), wallet.XMRToFloat64(mismatch.Audited))
+	}
+	for userid, indices := range r.DuplicateUserIDs {
+		out = fmt.Sprintf("%s\n\nUser ID %d on accounts %v", out, userid, indices)
+	}
+	for username, indices := range r.DuplicateUsernames {
+		out = fmt.Sprintf("%s\n\nUsername %s on accounts %v", out, username, indices)
+	}
+	for _, account := range r.Orphans {
+		out = fmt.Sprintf("%s\n\nOrphan account #%d (%s) with %f XMR", out, account.AccountIndex, account.Label, wallet.XMRToFloat64(account.Balance))
+	}
+	for _, account := range r.InvalidLabels {
+		out = fmt.Sprintf("%s\n\nInvalid label on account #%d: %q with %f XMR", out, account.AccountIndex, account.Label, wallet.XMRToFloat64(account.Balance))
+	}
+
+	return out
+}
+
+// reconciliationScheduler reconciles every RECONCILIATION_INTERVAL hours and reports discrepancies to ADMIN_CHAT_ID
+func (mtb *MoneroTipBot) reconciliationScheduler() {
+	for {
+		interval := time.Duration(viper.GetInt("RECONCILIATION_INTERVAL")) * time.Hour
+		if interval == 0 {
+			time.Sleep(time.Minute * 60)
+			continue
+		}
+
+		result, err := mtb.reconcile()
+		if err != nil {
+			jobLogger("reconcile").WithError(err).Error("Error while reconciling accounts")
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		if result.Discrepancies() > 0 {
+			jobLogger("reconcile").WithField("discrepancies", result.Discrepancies()).Warn("Reconciliation found discrepancies")
+			mtb.notifyAdmins("reconcile", result.String())
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// notifyAdmins sends text from the background job to ADMIN_CHAT_ID, if set
+func (mtb *MoneroTipBot) notifyAdmins(job string, text string) error {
+	chatid := viper.GetInt64("ADMIN_CHAT_ID")
+	if chatid == 0 {
+		return nil
+	}
+	// telegram messages are limited to 4096 characters
+	if runes := []rune(text); len(runes) > 4000 {
+		text = fmt.Sprintf("%s\n...", string(runes[:4000]))
+	}
+
+	return mtb.reply(&Message{
+		Format: true,
+		ChatID: chatid,
+		Text:   text,
+		log:    jobLogger(job),
+	})
+}
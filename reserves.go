@@ -0,0 +1,219 @@
+package monerotipbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omani/go-monero-rpc-client/wallet"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+var reservesmutex sync.Mutex
+
+// loadReserveProof reads the latest proof of reserves from RESERVES_FILE. A missing file means no proof yet.
+func loadReserveProof() (*ReserveProof, error) {
+	file, err := ioutil.ReadFile(viper.GetString("RESERVES_FILE"))
+	if err != nil {
+		return nil, nil
+	}
+
+	proof := &ReserveProof{}
+	err = json.Unmarshal(file, proof)
+	if err != nil {
+		return nil, err
+	}
+
+	return proof, nil
+}
+
+func saveReserveProofToFile(proof *ReserveProof) error {
+	file, err := json.MarshalIndent(proof, "", " ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(viper.GetString("RESERVES_FILE"), file, 0644)
+}
+
+// isUserAccountLabel reports whether label belongs to a user account (username@userid)
+func isUserAccountLabel(label string) bool {
+	split := strings.Split(label, "@")
+	if len(split) != 2 {
+		return false
+	}
+	_, err := strconv.ParseInt(split[1], 10, 64)
+	return err == nil
+}
+
+// createReserveProof proves the whole wallet balance and sums up what the bot owes its users
+func (mtb *MoneroTipBot) createReserveProof(walletrpc *resilientWallet) (*ReserveProof, error) {
+	now := time.Now().UTC()
+
+	accounts, err := walletrpc.GetAccounts(&wallet.RequestGetAccounts{})
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &ReserveProof{
+		Time:     now,
+		Message:  fmt.Sprintf("%s proof of reserves %s", viper.GetString("BOT_NAME"), now.Format(time.RFC3339)),
+		Reserves: accounts.TotalBalance,
+	}
+	for _, account := range accounts.SubaddressAccounts {
+		if isUserAccountLabel(account.Label) {
+			proof.Liabilities += account.Balance
+			proof.Accounts++
+		}
+	}
+	// pooled balances are owed to the users, whether the primary account keeps them hot or in cold storage
+	proof.Cold = mtb.totalColdBalance()
+	proof.Liabilities += proof.Cold
+
+	address, err := walletrpc.GetAddress(&wallet.RequestGetAddress{AccountIndex: 0})
+	if err != nil {
+		return nil, err
+	}
+	proof.Address = address.Address
+
+	resp, err := walletrpc.GetReserveProof(&wallet.RequestGetReserveProof{
+		All:     true,
+		Message: proof.Message,
+	})
+	if err != nil {
+		return nil, err
+	}
+	proof.Signature = resp.Signature
+
+	reservesmutex.Lock()
+	mtb.reserveproof = proof
+	err = saveReserveProofToFile(proof)
+	reservesmutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	mtb.metricIncr("reserve_proofs.counter", 1)
+	mtb.metricGauge("reserve_proof_liabilities.counter", wallet.XMRToFloat64(proof.Liabilities))
+
+	return proof, nil
+}
+
+func (proof *ReserveProof) String() string {
+	cold := ""
+	if proof.Cold > 0 {
+		cold = fmt.Sprintf("\nPooled balances: %f XMR (the part in cold storage is not covered by this proof)", wallet.XMRToFloat64(proof.Cold))
+	}
+	return fmt.Sprintf("Proof of reserves from %s\n\nReserves: %f XMR\nLiabilities: %f XMR (%d accounts)%s\n\nAddress: %s\nMessage: %s\n\nVerify the attached signature with monero-wallet-cli:\ncheck_reserve_proof ADDRESS reserveproof.txt \"MESSAGE\"", proof.Time.Format(time.RFC1123), wallet.XMRToFloat64(proof.Reserves), wallet.XMRToFloat64(proof.Liabilities), proof.Accounts, cold, proof.Address, proof.Message)
+}
+
+// sendReserveProof sends the summary and the signature as a file, since signatures exceed the message size limit.
+// The summary is logged with logger.
+func (mtb *MoneroTipBot) sendReserveProof(chatid int64, proof *ReserveProof, logger *logrus.Entry) error {
+	mtb.reply(&Message{
+		Format: true,
+		ChatID: chatid,
+		Text:   proof.String(),
+		log:    logger,
+	})
+
+	// the messages to a chat keep their order, the signature comes second
+	document := tgbotapi.NewDocumentUpload(chatid, tgbotapi.FileBytes{Name: "reserveproof.txt", Bytes: []byte(proof.Signature)})
+	mtb.send(document)
+	return nil
+}
+
+// publishReserveProof creates a new proof with walletrpc and posts it to RESERVES_CHANNEL_ID, if set
+func (mtb *MoneroTipBot) publishReserveProof(walletrpc *resilientWallet) (*ReserveProof, error) {
+	proof, err := mtb.createReserveProof(walletrpc)
+	if err != nil {
+		return nil, err
+	}
+
+	channel := viper.GetInt64("RESERVES_CHANNEL_ID")
+	if channel == 0 {
+		return proof, nil
+	}
+
+	// the scheduler publishes with the wallet of its job, /admin with the one of the update
+	return proof, mtb.sendReserveProof(channel, proof, walletrpc.logger())
+}
+
+// reservesScheduler publishes a proof of reserves every RESERVES_INTERVAL hours. 0 disables it.
+// After a failed attempt it waits RESERVES_INTERVAL, but at most 15 minutes, before trying again.
+func (mtb *MoneroTipBot) reservesScheduler() {
+	var failed time.Time
+	for {
+		interval := time.Duration(viper.GetInt("RESERVES_INTERVAL")) * time.Hour
+		if interval == 0 {
+			time.Sleep(time.Minute * 60)
+			continue
+		}
+
+		reservesmutex.Lock()
+		next := time.Now()
+		if mtb.reserveproof != nil {
+			next = mtb.reserveproof.Time.Add(interval)
+		}
+		reservesmutex.Unlock()
+
+		if !failed.IsZero() {
+			backoff := interval
+			if backoff > time.Minute*15 {
+				backoff = time.Minute * 15
+			}
+			if retry := failed.Add(backoff); retry.After(next) {
+				next = retry
+			}
+		}
+
+		if !time.Now().Before(next) {
+			_, err := mtb.publishReserveProof(mtb.jobWallet("reserves"))
+			if err != nil {
+				failed = time.Now()
+				jobLogger("reserves").WithError(err).Error("Error while publishing proof of reserves")
+			} else {
+				failed = time.Time{}
+			}
+		}
+
+		time.Sleep(time.Minute)
+	}
+}
+
+func (mtb *MoneroTipBot) parseCommandRESERVES() error {
+	msg := mtb.newReplyMessage(true)
+
+	// admins can create a new proof on demand
+	if strings.TrimSpace(mtb.message.CommandArguments()) == "now" {
+		if !mtb.isAdmin() {
+			msg.Text = "This command is only available to admins."
+			return mtb.reply(msg)
+		}
+		msg.Text = "Creating proof of reserves. This can take a while."
+		mtb.reply(msg)
+
+		_, err := mtb.publishReserveProof(mtb.walletrpc)
+		if err != nil {
+			msg.Text = fmt.Sprintf("Error while creating proof of reserves: %s", err)
+			return mtb.reply(msg)
+		}
+	}
+
+	reservesmutex.Lock()
+	proof := mtb.reserveproof
+	reservesmutex.Unlock()
+
+	if proof == nil {
+		msg.Text = "No proof of reserves available yet."
+		return mtb.reply(msg)
+	}
+
+	return mtb.sendReserveProof(mtb.getReplyID(), proof, mtb.logger())
+}
@@ -0,0 +1,344 @@
+package monerotipbot
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gabstv/httpdigest"
+	"github.com/gorilla/rpc/v2/json2"
+	"github.com/omani/go-monero-rpc-client/wallet"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var errCircuitOpen = errors.New("wallet RPC is unavailable (circuit breaker open). Please try again later.")
+
+// circuitBreaker stops calling the wallet RPC after WALLET_RPC_BREAKER_THRESHOLD consecutive failures
+// for WALLET_RPC_BREAKER_COOLDOWN seconds. After the cooldown a single call probes the wallet again.
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	failures  int
+	openuntil time.Time
+	probing   bool
+}
+
+func (cb *circuitBreaker) allow() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	threshold := viper.GetInt("WALLET_RPC_BREAKER_THRESHOLD")
+	if threshold == 0 || cb.failures < threshold {
+		return true
+	}
+	if time.Now().Before(cb.openuntil) || cb.probing {
+		return false
+	}
+	// half-open: let one call through
+	cb.probing = true
+	return true
+}
+
+func (cb *circuitBreaker) success() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.failures >= viper.GetInt("WALLET_RPC_BREAKER_THRESHOLD") && viper.GetInt("WALLET_RPC_BREAKER_THRESHOLD") > 0 {
+		logrus.WithField("component", "walletrpc").Info("Wallet RPC circuit breaker closed")
+	}
+	cb.failures = 0
+	cb.probing = false
+}
+
+// failure reports whether the breaker opened with this failure
+func (cb *circuitBreaker) failure() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.failures++
+	cb.probing = false
+
+	threshold := viper.GetInt("WALLET_RPC_BREAKER_THRESHOLD")
+	if threshold == 0 || cb.failures < threshold {
+		return false
+	}
+	cb.openuntil = time.Now().Add(time.Duration(viper.GetInt("WALLET_RPC_BREAKER_COOLDOWN")) * time.Second)
+	logrus.WithFields(logrus.Fields{"component": "walletrpc", "failures": cb.failures}).Error("Wallet RPC circuit breaker open")
+	return true
+}
+
+// resilientWallet wraps the wallet RPC client with timeouts, retries for idempotent calls, a circuit breaker and metrics.
+// Methods the bot doesn't use fall through to the embedded client.
+type resilientWallet struct {
+	wallet.Client
+	// transfers is a client with the longer WALLET_RPC_TRANSFER_TIMEOUT. Transfers are never retried.
+	transfers wallet.Client
+	breaker   *circuitBreaker
+
+	// store is the result of the last Store(), see save()
+	store *walletStore
+
+	metrics *Metrics
+	// logger returns the logger of the calls. For mtb.walletrpc it carries the correlation ID of the update
+	// being processed. Background jobs use a view with their jobLogger instead, see withLogger.
+	logger func() *logrus.Entry
+}
+
+func newWalletClient(timeout time.Duration) wallet.Client {
+	transport := httpdigest.New(viper.GetString("monero_rpc_daemon_username"), viper.GetString("monero_rpc_daemon_password"))
+	transport.Transport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+		ResponseHeaderTimeout: timeout,
+	}
+
+	return wallet.New(wallet.Config{
+		Address:   viper.GetString("monero_rpc_daemon_url"),
+		Transport: transport,
+	})
+}
+
+// newResilientWallet connects to monero_rpc_daemon_url with login if login specified in settings
+func newResilientWallet(metrics *Metrics, logger func() *logrus.Entry) *resilientWallet {
+	return &resilientWallet{
+		Client:    newWalletClient(time.Duration(viper.GetInt("WALLET_RPC_TIMEOUT")) * time.Second),
+		transfers: newWalletClient(time.Duration(viper.GetInt("WALLET_RPC_TRANSFER_TIMEOUT")) * time.Second),
+		breaker:   &circuitBreaker{},
+		store:     &walletStore{},
+		metrics:   metrics,
+		logger:    logger,
+	}
+}
+
+// withLogger returns a view of the wallet whose calls are logged with logger. It shares the clients,
+// the circuit breaker and the store state with rw.
+func (rw *resilientWallet) withLogger(logger *logrus.Entry) *resilientWallet {
+	return &resilientWallet{
+		Client:    rw.Client,
+		transfers: rw.transfers,
+		breaker:   rw.breaker,
+		store:     rw.store,
+		metrics:   rw.metrics,
+		logger: func() *logrus.Entry {
+			return logger
+		},
+	}
+}
+
+// jobWallet is the wallet of the background job job. Its calls carry the job instead of the correlation ID of
+// whatever update is processed at the same time.
+func (mtb *MoneroTipBot) jobWallet(job string) *resilientWallet {
+	return mtb.walletrpc.withLogger(jobLogger(job))
+}
+
+// isRPCError reports whether err came from the wallet itself (e.g. "not enough money"), not from the connection
+func isRPCError(err error) bool {
+	_, ok := err.(*json2.Error)
+	return ok
+}
+
+// call runs fn through the circuit breaker. Idempotent calls are retried WALLET_RPC_RETRIES times with exponential backoff.
+func (rw *resilientWallet) call(method string, idempotent bool, fn func() error) error {
+	attempts := 1
+	if idempotent {
+		attempts += viper.GetInt("WALLET_RPC_RETRIES")
+	}
+	backoff := time.Duration(viper.GetInt("WALLET_RPC_BACKOFF")) * time.Millisecond
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+			rw.metrics.Incr("walletrpc.*.retries", 1, label("method", method))
+		}
+
+		if !rw.breaker.allow() {
+			rw.metrics.Incr("walletrpc.*.rejected", 1, label("method", method))
+			return errCircuitOpen
+		}
+
+		start := time.Now()
+		err = fn()
+		rw.metrics.Timing("walletrpc.*.time", time.Since(start), label("method", method))
+		logger := rw.logger().WithFields(logrus.Fields{"method": method, "attempt": attempt + 1, "duration_ms": time.Since(start).Milliseconds()})
+		if err != nil {
+			logger = logger.WithError(err)
+		}
+		logger.Debug("Wallet RPC call")
+		rw.metrics.Incr("walletrpc.*.calls", 1, label("method", method))
+
+		// the wallet answered. an error of the wallet itself won't go away by retrying.
+		if err == nil || isRPCError(err) {
+			rw.breaker.success()
+			if err != nil {
+				rw.metrics.Incr("walletrpc.*.errors", 1, label("method", method))
+			}
+			return err
+		}
+
+		rw.metrics.Incr("walletrpc.*.errors", 1, label("method", method))
+		logger.Warn("Wallet RPC call failed")
+		if rw.breaker.failure() {
+			rw.metrics.Incr("walletrpc.breaker_open.counter", 1)
+		}
+	}
+
+	return err
+}
+
+// idempotent calls
+
+func (rw *resilientWallet) GetBalance(req *wallet.RequestGetBalance) (resp *wallet.ResponseGetBalance, err error) {
+	err = rw.call("get_balance", true, func() error {
+		resp, err = rw.Client.GetBalance(req)
+		return err
+	})
+	return resp, err
+}
+
+func (rw *resilientWallet) GetAddress(req *wallet.RequestGetAddress) (resp *wallet.ResponseGetAddress, err error) {
+	err = rw.call("get_address", true, func() error {
+		resp, err = rw.Client.GetAddress(req)
+		return err
+	})
+	return resp, err
+}
+
+func (rw *resilientWallet) ValidateAddress(req *wallet.RequestValidateAddress) (resp *wallet.ResponseValidateAddress, err error) {
+	err = rw.call("validate_address", true, func() error {
+		resp, err = rw.Client.ValidateAddress(req)
+		return err
+	})
+	return resp, err
+}
+
+func (rw *resilientWallet) GetAccounts(req *wallet.RequestGetAccounts) (resp *wallet.ResponseGetAccounts, err error) {
+	err = rw.call("get_accounts", true, func() error {
+		resp, err = rw.Client.GetAccounts(req)
+		return err
+	})
+	return resp, err
+}
+
+func (rw *resilientWallet) LabelAccount(req *wallet.RequestLabelAccount) (err error) {
+	err = rw.call("label_account", true, func() error {
+		return rw.Client.LabelAccount(req)
+	})
+	if err == nil {
+		rw.save()
+	}
+	return err
+}
+
+func (rw *resilientWallet) GetHeight() (resp *wallet.ResponseGetHeight, err error) {
+	err = rw.call("get_height", true, func() error {
+		resp, err = rw.Client.GetHeight()
+		return err
+	})
+	return resp, err
+}
+
+func (rw *resilientWallet) Store() (err error) {
+	return rw.call("store", true, func() error {
+		return rw.Client.Store()
+	})
+}
+
+func (rw *resilientWallet) GetTxKey(req *wallet.RequestGetTxKey) (resp *wallet.ResponseGetTxKey, err error) {
+	err = rw.call("get_tx_key", true, func() error {
+		resp, err = rw.Client.GetTxKey(req)
+		return err
+	})
+	return resp, err
+}
+
+func (rw *resilientWallet) GetTxProof(req *wallet.RequestGetTxProof) (resp *wallet.ResponseGetTxProof, err error) {
+	err = rw.call("get_tx_proof", true, func() error {
+		resp, err = rw.Client.GetTxProof(req)
+		return err
+	})
+	return resp, err
+}
+
+func (rw *resilientWallet) CheckTxProof(req *wallet.RequestCheckTxProof) (resp *wallet.ResponseCheckTxProof, err error) {
+	err = rw.call("check_tx_proof", true, func() error {
+		resp, err = rw.Client.CheckTxProof(req)
+		return err
+	})
+	return resp, err
+}
+
+func (rw *resilientWallet) GetReserveProof(req *wallet.RequestGetReserveProof) (resp *wallet.ResponseGetReserveProof, err error) {
+	err = rw.call("get_reserve_proof", true, func() error {
+		resp, err = rw.Client.GetReserveProof(req)
+		return err
+	})
+	return resp, err
+}
+
+func (rw *resilientWallet) GetTransferByTxID(req *wallet.RequestGetTransferByTxID) (resp *wallet.ResponseGetTransferByTxID, err error) {
+	err = rw.call("get_transfer_by_txid", true, func() error {
+		resp, err = rw.Client.GetTransferByTxID(req)
+		return err
+	})
+	return resp, err
+}
+
+func (rw *resilientWallet) ParseURI(req *wallet.RequestParseURI) (resp *wallet.ResponseParseURI, err error) {
+	err = rw.call("parse_uri", true, func() error {
+		resp, err = rw.Client.ParseURI(req)
+		return err
+	})
+	return resp, err
+}
+
+// calls that change the wallet. a retry after a timeout could create a second account or send the funds twice.
+// the wallet is stored right after each of them.
+
+func (rw *resilientWallet) CreateAccount(req *wallet.RequestCreateAccount) (resp *wallet.ResponseCreateAccount, err error) {
+	err = rw.call("create_account", false, func() error {
+		resp, err = rw.Client.CreateAccount(req)
+		return err
+	})
+	if err == nil {
+		rw.save()
+	}
+	return resp, err
+}
+
+func (rw *resilientWallet) CreateAddress(req *wallet.RequestCreateAddress) (resp *wallet.ResponseCreateAddress, err error) {
+	err = rw.call("create_address", false, func() error {
+		resp, err = rw.Client.CreateAddress(req)
+		return err
+	})
+	if err == nil {
+		rw.save()
+	}
+	return resp, err
+}
+
+func (rw *resilientWallet) Transfer(req *wallet.RequestTransfer) (resp *wallet.ResponseTransfer, err error) {
+	err = rw.call("transfer", false, func() error {
+		resp, err = rw.transfers.Transfer(req)
+		return err
+	})
+	// a transfer that timed out might have been sent anyway
+	if !req.DoNotRelay && !isRPCError(err) {
+		rw.save()
+	}
+	return resp, err
+}
+
+func (rw *resilientWallet) SweepAll(req *wallet.RequestSweepAll) (resp *wallet.ResponseSweepAll, err error) {
+	err = rw.call("sweep_all", false, func() error {
+		resp, err = rw.transfers.SweepAll(req)
+		return err
+	})
+	if !req.DoNotRelay && !isRPCError(err) {
+		rw.save()
+	}
+	return resp, err
+}
@@ -0,0 +1,457 @@
+package monerotipbot
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"github.com/makiuchi-d/gozxing/qrcode/decoder"
+	"github.com/spf13/viper"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const (
+	secondFactorPIN  = "pin"
+	secondFactorTOTP = "totp"
+
+	pinHashIterations   = 100000
+	totpPeriod          = 30
+	confirmationTimeout = 5 * time.Minute
+)
+
+var (
+	errSecondFactorRequired = errors.New("Second factor required")
+	errSecondFactorLocked   = errors.New("Too many failed attempts")
+	errSecondFactorInvalid  = errors.New("Invalid code")
+)
+
+// loadSecondFactors reads all second factors from SECOND_FACTOR_FILE. A missing file means no second factors yet.
+func loadSecondFactors() (map[int64]*SecondFactor, error) {
+	secondfactors := make(map[int64]*SecondFactor)
+
+	file, err := ioutil.ReadFile(viper.GetString("SECOND_FACTOR_FILE"))
+	if err != nil {
+		return secondfactors, nil
+	}
+
+	var entries []*SecondFactor
+	err = json.Unmarshal(file, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		secondfactors[entry.UserID] = entry
+	}
+
+	return secondfactors, nil
+}
+
+func (mtb *MoneroTipBot) saveSecondFactorsToFile() error {
+	var entries []*SecondFactor
+	for _, entry := range mtb.secondfactors {
+		entries = append(entries, entry)
+	}
+
+	file, err := json.MarshalIndent(entries, "", " ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(viper.GetString("SECOND_FACTOR_FILE"), file, 0600)
+}
+
+// hasSecondFactor reports whether the current user has a PIN or TOTP set
+func (mtb *MoneroTipBot) hasSecondFactor() bool {
+	secondfactor, ok := mtb.secondfactors[int64(mtb.from.ID)]
+	return ok && len(secondfactor.Method) > 0
+}
+
+// requireSecondFactor parks the current request and asks the user to /confirm it,
+// unless the user has no second factor or the request has already been confirmed.
+func (mtb *MoneroTipBot) requireSecondFactor() error {
+	if mtb.secondfactorverified || !mtb.hasSecondFactor() {
+		return nil
+	}
+
+	mtb.pendingconfirmations[int64(mtb.from.ID)] = &PendingConfirmation{
+		Message:  mtb.message,
+		Callback: mtb.callback,
+		Expires:  time.Now().Add(confirmationTimeout),
+	}
+
+	msg := mtb.newReplyMessage(true)
+	msg.ChatID = int64(mtb.from.ID)
+	msg.Text = fmt.Sprintf("This request needs your %s. Confirm it within %s with: /confirm YOURCODE", strings.ToUpper(mtb.secondfactors[int64(mtb.from.ID)].Method), confirmationTimeout)
+	mtb.reply(msg)
+
+	return errSecondFactorRequired
+}
+
+// verifySecondFactor checks code against the user's second factor and handles lockouts
+func (mtb *MoneroTipBot) verifySecondFactor(secondfactor *SecondFactor, code string, now time.Time) error {
+	if now.Before(secondfactor.LockedUntil) {
+		return errSecondFactorLocked
+	}
+
+	var err error
+	switch secondfactor.Method {
+	case secondFactorPIN:
+		err = checkPIN(secondfactor, code)
+	case secondFactorTOTP:
+		var secret []byte
+		secret, err = decryptSecret(secondfactor.TOTPSecret)
+		if err != nil {
+			return err
+		}
+		var step int64
+		step, err = checkTOTP(secret, code, now)
+		if err == nil {
+			if step <= secondfactor.LastTOTPStep {
+				err = errSecondFactorInvalid
+			} else {
+				secondfactor.LastTOTPStep = step
+			}
+		}
+	default:
+		return nil
+	}
+
+	if err != nil {
+		secondfactor.FailedAttempts++
+		if secondfactor.FailedAttempts >= viper.GetInt("SECOND_FACTOR_MAX_ATTEMPTS") {
+			secondfactor.FailedAttempts = 0
+			secondfactor.LockedUntil = now.Add(time.Duration(viper.GetInt("SECOND_FACTOR_LOCKOUT")) * time.Minute)
+			mtb.metricIncr("second_factor_lockouts.counter", 1)
+			err = errSecondFactorLocked
+		}
+		mtb.saveSecondFactorsToFile()
+		return err
+	}
+
+	secondfactor.FailedAttempts = 0
+	return mtb.saveSecondFactorsToFile()
+}
+
+func (mtb *MoneroTipBot) parseCommandCONFIRM() error {
+	msg := mtb.newReplyMessage(true)
+
+	// never leave a PIN in the chat history
+	mtb.deleteCommandMessage()
+
+	userid := int64(mtb.from.ID)
+	pending, ok := mtb.pendingconfirmations[userid]
+	if !ok {
+		msg.Text = "Nothing to confirm."
+		return mtb.reply(msg)
+	}
+	if time.Now().After(pending.Expires) {
+		delete(mtb.pendingconfirmations, userid)
+		msg.Text = "Confirmation expired. Please repeat your request."
+		return mtb.reply(msg)
+	}
+
+	code := strings.TrimSpace(mtb.message.CommandArguments())
+	if len(code) == 0 {
+		msg.Text = "Please specify your code: /confirm YOURCODE"
+		return mtb.reply(msg)
+	}
+
+	err := mtb.verifySecondFactor(mtb.secondfactors[userid], code, time.Now())
+	if err == errSecondFactorLocked {
+		delete(mtb.pendingconfirmations, userid)
+		msg.Text = fmt.Sprintf("Too many failed attempts. Your account is locked for sensitive requests until %s.", mtb.secondfactors[userid].LockedUntil.Format(time.RFC1123))
+		return mtb.reply(msg)
+	}
+	if err != nil {
+		msg.Text = fmt.Sprintf("Error: %s", err)
+		return mtb.reply(msg)
+	}
+	delete(mtb.pendingconfirmations, userid)
+
+	// replay the original request. it will pass requireSecondFactor() this time.
+	mtb.secondfactorverified = true
+	if pending.Callback != nil {
+		mtb.callback = pending.Callback
+		mtb.message = pending.Callback.Message
+		return mtb.processQRCode()
+	}
+	mtb.message = pending.Message
+	return mtb.parseCommand()
+}
+
+func (mtb *MoneroTipBot) parseCommandSECURITY() error {
+	msg := mtb.newReplyMessage(true)
+
+	userid := int64(mtb.from.ID)
+	secondfactor, ok := mtb.secondfactors[userid]
+	if !ok {
+		secondfactor = &SecondFactor{UserID: userid}
+	}
+
+	split := strings.Fields(mtb.message.CommandArguments())
+	if len(split) == 0 {
+		method := "none"
+		if len(secondfactor.Method) > 0 {
+			method = strings.ToUpper(secondfactor.Method)
+		}
+		msg.Text = fmt.Sprintf("Second factor: %s", method)
+		return mtb.reply(msg)
+	}
+
+	switch split[0] {
+	case secondFactorPIN:
+		// never leave a PIN in the chat history
+		mtb.deleteCommandMessage()
+
+		if len(split) != 2 {
+			msg.Text = "Please specify your new PIN: /security pin 123456"
+			return mtb.reply(msg)
+		}
+		minlength := viper.GetInt("SECOND_FACTOR_MIN_PIN_LENGTH")
+		if len(split[1]) < minlength {
+			msg.Text = fmt.Sprintf("PIN must have at least %d characters.", minlength)
+			return mtb.reply(msg)
+		}
+		err := mtb.requireSecondFactor()
+		if err != nil {
+			return err
+		}
+
+		salt := make([]byte, 16)
+		_, err = rand.Read(salt)
+		if err != nil {
+			return err
+		}
+		secondfactor.Method = secondFactorPIN
+		secondfactor.PINSalt = base64.StdEncoding.EncodeToString(salt)
+		secondfactor.PINHash = base64.StdEncoding.EncodeToString(pbkdf2SHA256([]byte(split[1]), salt, pinHashIterations))
+		secondfactor.TOTPSecret = ""
+		secondfactor.PendingTOTPSecret = ""
+		msg.Text = "PIN set. /withdraw, larger /send amounts and changes to your security settings now need to be confirmed with your PIN."
+	case secondFactorTOTP:
+		// activate a previously generated secret with the first valid code
+		if len(split) == 2 {
+			if len(secondfactor.PendingTOTPSecret) == 0 {
+				msg.Text = "No TOTP secret to activate. Type /security totp first."
+				return mtb.reply(msg)
+			}
+			secret, err := decryptSecret(secondfactor.PendingTOTPSecret)
+			if err != nil {
+				return err
+			}
+			step, err := checkTOTP(secret, split[1], time.Now())
+			if err != nil {
+				msg.Text = "Invalid code. Make sure the time on your device is correct and try again."
+				return mtb.reply(msg)
+			}
+			secondfactor.Method = secondFactorTOTP
+			secondfactor.TOTPSecret = secondfactor.PendingTOTPSecret
+			secondfactor.PendingTOTPSecret = ""
+			secondfactor.LastTOTPStep = step
+			secondfactor.PINSalt = ""
+			secondfactor.PINHash = ""
+			msg.Text = "TOTP activated. /withdraw, larger /send amounts and changes to your security settings now need to be confirmed with a code from your authenticator app."
+			break
+		}
+
+		if len(viper.GetString("SECOND_FACTOR_ENCRYPTION_KEY")) == 0 {
+			msg.Text = "TOTP is not available on this bot. Please use a PIN instead."
+			return mtb.reply(msg)
+		}
+		err := mtb.requireSecondFactor()
+		if err != nil {
+			return err
+		}
+
+		secret := make([]byte, 20)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return err
+		}
+		encrypted, err := encryptSecret(secret)
+		if err != nil {
+			return err
+		}
+		secondfactor.PendingTOTPSecret = encrypted
+
+		encodedsecret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+		uri := fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s&period=%d", url.PathEscape(viper.GetString("BOT_NAME")), url.PathEscape(mtb.getUsername()), encodedsecret, url.QueryEscape(viper.GetString("BOT_NAME")), totpPeriod)
+		img, err := encodeQRCodePNG(uri)
+		if err != nil {
+			return err
+		}
+		photomsg := tgbotapi.NewPhotoUpload(int64(mtb.from.ID), tgbotapi.FileBytes{Name: "image.png", Bytes: img})
+		mtb.send(photomsg)
+
+		msg.Text = fmt.Sprintf("Scan the QR-Code with your authenticator app or enter this secret manually:\n\n%s\n\nThen activate it with: /security totp CODE", encodedsecret)
+	case "off":
+		if !mtb.hasSecondFactor() {
+			msg.Text = "No second factor set."
+			return mtb.reply(msg)
+		}
+		err := mtb.requireSecondFactor()
+		if err != nil {
+			return err
+		}
+		delete(mtb.secondfactors, userid)
+		err = mtb.saveSecondFactorsToFile()
+		if err != nil {
+			msg.Text = fmt.Sprintf("Error while saving security settings: %s", err)
+			return mtb.reply(msg)
+		}
+		msg.Text = "Second factor removed."
+		return mtb.reply(msg)
+	default:
+		msg.Text = "Unknown security command. See /help security"
+		return mtb.reply(msg)
+	}
+
+	mtb.secondfactors[userid] = secondfactor
+	err := mtb.saveSecondFactorsToFile()
+	if err != nil {
+		msg.Text = fmt.Sprintf("Error while saving security settings: %s", err)
+		return mtb.reply(msg)
+	}
+	mtb.metricIncr("second_factor_changed.counter", 1)
+
+	return mtb.reply(msg)
+}
+
+func (mtb *MoneroTipBot) deleteCommandMessage() {
+	mtb.bot.DeleteMessage(tgbotapi.NewDeleteMessage(mtb.message.Chat.ID, mtb.message.MessageID))
+}
+
+func checkPIN(secondfactor *SecondFactor, pin string) error {
+	salt, err := base64.StdEncoding.DecodeString(secondfactor.PINSalt)
+	if err != nil {
+		return err
+	}
+	hash, err := base64.StdEncoding.DecodeString(secondfactor.PINHash)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(hash, pbkdf2SHA256([]byte(pin), salt, pinHashIterations)) {
+		return errSecondFactorInvalid
+	}
+	return nil
+}
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018) with HMAC-SHA256, limited to a single 32 byte block
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+
+	out := make([]byte, len(u))
+	copy(out, u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+// totpCode computes the 6 digit TOTP (RFC 6238) code for the given time step
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// checkTOTP accepts codes of the current, previous and next time step and returns the matching step
+func checkTOTP(secret []byte, code string, now time.Time) (int64, error) {
+	current := now.Unix() / totpPeriod
+	for _, step := range []int64{current - 1, current, current + 1} {
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, nil
+		}
+	}
+	return 0, errSecondFactorInvalid
+}
+
+func secondFactorCipher() (cipher.AEAD, error) {
+	key := viper.GetString("SECOND_FACTOR_ENCRYPTION_KEY")
+	if len(key) == 0 {
+		return nil, errors.New("SECOND_FACTOR_ENCRYPTION_KEY not set")
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptSecret(secret []byte) (string, error) {
+	aead, err := secondFactorCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func decryptSecret(encrypted string) ([]byte, error) {
+	aead, err := secondFactorCipher()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("Encrypted secret too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+func encodeQRCodePNG(content string) ([]byte, error) {
+	qrWriter := qrcode.NewQRCodeWriter()
+	hints := map[gozxing.EncodeHintType]interface{}{gozxing.EncodeHintType_ERROR_CORRECTION: decoder.ErrorCorrectionLevel_L}
+	qrcode, err := qrWriter.Encode(content, gozxing.BarcodeFormat_QR_CODE, 400, 400, hints)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	err = png.Encode(buf, qrcode)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,83 @@
+package monerotipbot
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// published PBKDF2-HMAC-SHA256 vectors with a 32 byte key (RFC 7914 section 11 and the RFC 6070 inputs)
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		key        string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1"},
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+	}
+
+	for _, test := range tests {
+		key := hex.EncodeToString(pbkdf2SHA256([]byte(test.password), []byte(test.salt), test.iterations))
+		if key != test.key {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", test.password, test.salt, test.iterations, key, test.key)
+		}
+	}
+}
+
+// the SHA1 vectors of RFC 6238 appendix B, cut to the 6 digits the bot uses
+var totpVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+var totpSecret = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	for _, test := range totpVectors {
+		code := totpCode(totpSecret, test.unix/totpPeriod)
+		if code != test.code {
+			t.Errorf("totpCode at %d = %s, want %s", test.unix, code, test.code)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	for _, test := range totpVectors {
+		step := test.unix / totpPeriod
+		for _, offset := range []int64{-1, 0, 1} {
+			now := time.Unix((step+offset)*totpPeriod, 0)
+			matched, err := checkTOTP(totpSecret, test.code, now)
+			if err != nil {
+				t.Errorf("code %s of step %d refused %d steps later", test.code, step, offset)
+			} else if matched != step {
+				t.Errorf("code %s matched step %d, want %d", test.code, matched, step)
+			}
+		}
+		for _, offset := range []int64{-2, 2} {
+			now := time.Unix((step+offset)*totpPeriod, 0)
+			_, err := checkTOTP(totpSecret, test.code, now)
+			if err != errSecondFactorInvalid {
+				t.Errorf("code %s of step %d accepted %d steps later", test.code, step, offset)
+			}
+		}
+	}
+
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		_, err := checkTOTP(totpSecret, code, time.Unix(59, 0))
+		if err != errSecondFactorInvalid {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+}
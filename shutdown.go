@@ -0,0 +1,110 @@
+package monerotipbot
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+var shutdownmutex sync.Mutex
+
+// beginWork registers background work that moves funds, so Shutdown waits for it.
+// It returns false once the bot is shutting down. Call mtb.inflight.Done() when finished.
+func (mtb *MoneroTipBot) beginWork() bool {
+	shutdownmutex.Lock()
+	defer shutdownmutex.Unlock()
+
+	if mtb.stopping {
+		return false
+	}
+	mtb.inflight.Add(1)
+	return true
+}
+
+func (mtb *MoneroTipBot) isStopping() bool {
+	shutdownmutex.Lock()
+	defer shutdownmutex.Unlock()
+	return mtb.stopping
+}
+
+// receiveUpdates hands out updates until Shutdown is called. An update taken from updates is always handed out,
+// because Telegram may already consider it delivered. Both sources pass one update at a time (see getUpdates and
+// webhookHandler), so the updates not taken yet are not confirmed to Telegram and will be delivered again after a restart.
+func (mtb *MoneroTipBot) receiveUpdates(updates <-chan tgbotapi.Update) <-chan tgbotapi.Update {
+	incoming := make(chan tgbotapi.Update)
+	go func() {
+		defer close(incoming)
+		for {
+			select {
+			case <-mtb.shutdown:
+				return
+			case update := <-updates:
+				incoming <- update
+			}
+		}
+	}()
+	return incoming
+}
+
+// Shutdown stops fetching updates and waits up to SHUTDOWN_TIMEOUT seconds for the update in progress and running
+// transfers. Then it saves the giveaways and the wallet and closes the ZMQ socket and the metrics.
+// It returns an error if something didn't finish in time or couldn't be saved.
+func (mtb *MoneroTipBot) Shutdown() error {
+	shutdownmutex.Lock()
+	if mtb.stopping {
+		shutdownmutex.Unlock()
+		return errors.New("already shutting down")
+	}
+	mtb.stopping = true
+	close(mtb.shutdown)
+	shutdownmutex.Unlock()
+
+	mtb.bot.StopReceivingUpdates()
+	mtb.closeWebhook()
+
+	done := make(chan struct{})
+	go func() {
+		<-mtb.stopped
+		mtb.inflight.Wait()
+		close(done)
+	}()
+
+	var failed error
+	select {
+	case <-done:
+	case <-time.After(time.Duration(viper.GetInt("SHUTDOWN_TIMEOUT")) * time.Second):
+		failed = errors.New("timed out waiting for requests in progress")
+		logrus.WithError(failed).Error("Error while shutting down")
+	}
+
+	err := mtb.saveGiveawayToFile()
+	if err != nil {
+		logrus.WithError(err).Error("Error while saving giveaways")
+		failed = err
+	}
+	groupsmutex.Lock()
+	err = mtb.saveGroupsToFile()
+	groupsmutex.Unlock()
+	if err != nil {
+		logrus.WithError(err).Error("Error while saving groups")
+		failed = err
+	}
+	err = mtb.storeWallet()
+	if err != nil {
+		failed = err
+	}
+
+	// the last receipts and reports
+	if !mtb.outbox.drain(time.Second * 10) {
+		logrus.Error("Error while shutting down: outbox not empty")
+	}
+
+	mtb.rpcchannel.Close()
+	mtb.metrics.Close()
+
+	return failed
+}
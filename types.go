@@ -1,7 +1,10 @@
 package monerotipbot
 
 import (
+	"time"
+
 	"github.com/omani/go-monero-rpc-client/wallet"
+	"github.com/sirupsen/logrus"
 	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
 
@@ -22,6 +25,15 @@ type Message struct {
 	Text   string
 	Format bool
 	ChatID int64
+	// Keep is set for announcements in groups, which are not cleaned up like other replies
+	Keep bool
+	// Receipt is set for the confirmations of transfers, which are sent before the messages waiting for other chats
+	Receipt bool
+	// Done is called with the outcome once the message is sent (nil) or failed for good, e.g. to fall back to the group
+	// if the user never started the bot. It runs on a goroutine of the outbox, so it must not touch the current update.
+	Done func(err error)
+	// log is the logger of the update the message belongs to, for the replies sent from Done. Empty means the current update.
+	log *logrus.Entry
 }
 
 // Tip represents a tip
@@ -69,3 +81,298 @@ type Account struct {
 	// Unlocked balance for the account.
 	UnlockedBalance uint64
 }
+
+// Whitelist is a json tagged struct to save it as a file on disk and represents the withdrawal address whitelist of a user
+type Whitelist struct {
+	// UserID is the telegram user id the whitelist belongs to
+	UserID int64 `json:"userid"`
+	// Enabled restricts /send and /withdraw to whitelisted addresses if set
+	Enabled bool `json:"enabled"`
+	// Addresses are the addresses that are allowed as destination
+	Addresses []string `json:"addresses"`
+	// Pending are time-locked changes that are not in effect yet
+	Pending []*WhitelistChange `json:"pending"`
+}
+
+// WhitelistChange represents a time-locked change to a whitelist
+type WhitelistChange struct {
+	// Action is either "add" or "disable"
+	Action string `json:"action"`
+	// Address is the address to add (only set for "add")
+	Address string `json:"address"`
+	// EffectiveAt is the time the change takes effect
+	EffectiveAt time.Time `json:"effective_at"`
+}
+
+// SecondFactor is a json tagged struct to save it as a file on disk and represents the second factor of a user
+type SecondFactor struct {
+	// UserID is the telegram user id the second factor belongs to
+	UserID int64 `json:"userid"`
+	// Method is either "pin" or "totp". Empty if no second factor is set
+	Method string `json:"method"`
+	// PINSalt is the base64 encoded salt of PINHash
+	PINSalt string `json:"pin_salt"`
+	// PINHash is the base64 encoded PBKDF2 hash of the PIN
+	PINHash string `json:"pin_hash"`
+	// TOTPSecret is the encrypted TOTP secret
+	TOTPSecret string `json:"totp_secret"`
+	// PendingTOTPSecret is the encrypted TOTP secret waiting to be activated with a valid code
+	PendingTOTPSecret string `json:"pending_totp_secret"`
+	// LastTOTPStep is the time step of the last accepted TOTP code. Codes can't be used twice
+	LastTOTPStep int64 `json:"last_totp_step"`
+	// FailedAttempts counts wrong codes since the last lockout or success
+	FailedAttempts int `json:"failed_attempts"`
+	// LockedUntil is set after too many failed attempts
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// PendingConfirmation will always be in memory. Represents a request waiting for the second factor of a user
+type PendingConfirmation struct {
+	Message  *tgbotapi.Message
+	Callback *tgbotapi.CallbackQuery
+	Expires  time.Time
+}
+
+// Limits is a json tagged struct to save it as a file on disk and represents the spending limits and usage of a user
+type Limits struct {
+	// UserID is the telegram user id the limits belong to
+	UserID int64 `json:"userid"`
+	// DailyLimit is the user's own daily outgoing cap. 0 means the global default applies
+	DailyLimit uint64 `json:"daily_limit"`
+	// MaxTip is the user's own maximum for a single tip. 0 means the global default applies
+	MaxTip uint64 `json:"max_tip"`
+	// TipCooldown is the user's own minimum number of seconds between tips. 0 means the global default applies
+	TipCooldown int `json:"tip_cooldown"`
+	// Day is the UTC day (YYYY-MM-DD) SpentToday belongs to
+	Day string `json:"day"`
+	// SpentToday is the amount sent on Day
+	SpentToday uint64 `json:"spent_today"`
+	// LastTip is the time of the last tip
+	LastTip time.Time `json:"last_tip"`
+}
+
+// ReserveProof is a json tagged struct to save it as a file on disk and represents the latest proof of reserves of the bot wallet
+type ReserveProof struct {
+	// Time the proof was created
+	Time time.Time `json:"time"`
+	// Address is the primary address of the wallet the proof has to be checked against
+	Address string `json:"address"`
+	// Message is the message signed with the proof
+	Message string `json:"message"`
+	// Signature is the reserve proof
+	Signature string `json:"signature"`
+	// Reserves is the total balance of the wallet
+	Reserves uint64 `json:"reserves"`
+	// Liabilities is the sum of the balances of all user accounts
+	Liabilities uint64 `json:"liabilities"`
+	// Accounts is the number of user accounts
+	Accounts int `json:"accounts"`
+	// Cold is the part of the liabilities held in cold storage. It is not covered by the proof
+	Cold uint64 `json:"cold"`
+}
+
+// Reconciliation will always be in memory. Represents the result of comparing the wallet accounts with the users of the bot
+type Reconciliation struct {
+	Time time.Time
+	// Accounts is the number of accounts in the wallet
+	Accounts int
+	// UserAccounts is the number of accounts labelled username@userid with a known userid
+	UserAccounts int
+	// DuplicateUserIDs are telegram user ids labelled on more than one account
+	DuplicateUserIDs map[int64][]uint64
+	// DuplicateUsernames are usernames labelled on more than one account
+	DuplicateUsernames map[string][]uint64
+	// Orphans are username@0 accounts whose username also belongs to an account with a known userid
+	Orphans []*Account
+	// Unclaimed are username@0 accounts created by tipping users who never started the bot
+	Unclaimed []*Account
+	// InvalidLabels are accounts (besides the primary account) without a username@userid label
+	InvalidLabels []*Account
+	// PoolMismatches are accounts whose pooled balance doesn't match the pool credits and debits in the audit log
+	PoolMismatches []*PoolMismatch
+}
+
+// PoolMismatch is an account whose pooled balance in COLD_ALLOCATIONS_FILE differs from the audit log
+type PoolMismatch struct {
+	AccountIndex uint64
+	// Ledger is the pooled balance in COLD_ALLOCATIONS_FILE
+	Ledger uint64
+	// Audited is the pooled balance replayed from the audit log
+	Audited uint64
+}
+
+// ColdAllocation is a json tagged struct to save it as a file on disk and represents the pooled balance of an account:
+// the part of its balance that was consolidated into the primary account, which keeps it hot or in cold storage
+type ColdAllocation struct {
+	// AccountIndex is the wallet account the pooled balance belongs to
+	AccountIndex uint64 `json:"account_index"`
+	// Amount is the pooled balance of this account, including the fees of moving it to the primary account
+	Amount uint64 `json:"amount"`
+}
+
+// Withdrawal is the outcome of a withdrawal of the unlocked and the pooled balance of an account
+type Withdrawal struct {
+	Amount   uint64
+	Fee      uint64
+	TxHashes []string
+}
+
+// Approval is a json tagged struct to save it as a file on disk and represents a send or withdrawal waiting for an admin
+type Approval struct {
+	// ID identifies the approval in callbacks and admin commands
+	ID int64 `json:"id"`
+	// Kind is either "send" or "withdraw"
+	Kind string `json:"kind"`
+	// UserID is the telegram user id of the requesting user
+	UserID int64 `json:"userid"`
+	// Username is the telegram username of the requesting user
+	Username string `json:"username"`
+	// ChatID is the chat the user is notified in
+	ChatID int64 `json:"chat_id"`
+	// AccountIndex is the wallet account the funds are sent from
+	AccountIndex uint64 `json:"account_index"`
+	// Address is the destination address
+	Address string `json:"address"`
+	// Amount is the amount to send. For withdrawals it is the unlocked balance at the time of the request
+	Amount uint64 `json:"amount"`
+	// Priority is the transaction priority chosen by the user
+	Priority wallet.Priority `json:"priority"`
+	// Created is the time of the request
+	Created time.Time `json:"created"`
+	// MessageID is the id of the message with the Approve/Reject buttons in ADMIN_CHAT_ID
+	MessageID int `json:"message_id"`
+}
+
+// OperatorState is a json tagged struct to save it as a file on disk and represents the maintenance mode and the frozen accounts
+type OperatorState struct {
+	// Maintenance disables all transfers while set
+	Maintenance bool `json:"maintenance"`
+	// Frozen are the accounts that can't send funds
+	Frozen []*FrozenAccount `json:"frozen"`
+}
+
+// FrozenAccount represents a wallet account frozen by an admin
+type FrozenAccount struct {
+	// AccountIndex is the frozen wallet account
+	AccountIndex uint64 `json:"account_index"`
+	// Label is the label of the account at the time of the freeze
+	Label string `json:"label"`
+	// Reason is given by the admin
+	Reason string `json:"reason"`
+	// By is the telegram user id of the admin
+	By int64 `json:"by"`
+	// Since is the time of the freeze
+	Since time.Time `json:"since"`
+}
+
+// AuditEntry is a json tagged struct and represents one line of the append-only audit log. Every entry hashes the previous one.
+type AuditEntry struct {
+	// Seq is the position of the entry in the log, starting at 1
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// Action is what happened, e.g. "tip", "send", "withdraw", "giveaway_claim" or "admin"
+	Action string `json:"action"`
+	// UserID is the telegram user id whose funds moved (or the admin for admin actions). 0 for actions of the bot itself
+	UserID int64 `json:"userid"`
+	// Username is the telegram username of UserID
+	Username string `json:"username"`
+	// ChatID is the chat the action was requested in
+	ChatID int64 `json:"chat_id"`
+	// AccountIndex is the wallet account the funds are sent from
+	AccountIndex uint64 `json:"account_index"`
+	// Counterparty is the recipient (username or address)
+	Counterparty string `json:"counterparty"`
+	Amount       uint64 `json:"amount"`
+	Fee          uint64 `json:"fee"`
+	TxHash       string `json:"tx_hash"`
+	// Outcome is "ok" or the error
+	Outcome string `json:"outcome"`
+	// Details holds everything else worth knowing in a dispute
+	Details string `json:"details"`
+	// PrevHash is the hash of the previous entry. Empty for the first entry
+	PrevHash string `json:"prev_hash"`
+	// Hash is the hex encoded SHA-256 of this entry with an empty Hash
+	Hash string `json:"hash"`
+}
+
+// Health will always be in memory. Represents the last health check of the wallet RPC and the daemon
+type Health struct {
+	Healthy bool
+	// Reason explains why the wallet is unhealthy
+	Reason string
+	// WalletHeight is the height the wallet is synced to
+	WalletHeight uint64
+	// DaemonHeight is the height of the daemon. 0 if monero_daemon_url is not set
+	DaemonHeight uint64
+	// TargetHeight is the height the daemon is syncing to. 0 if the daemon is synced
+	TargetHeight uint64
+	// Latency is the round trip time of the wallet RPC
+	Latency time.Duration
+	// Stored is the time the wallet was last stored successfully
+	Stored time.Time
+	// Checked is the time of the last check
+	Checked time.Time
+	// Since is the time of the last change between healthy and unhealthy
+	Since time.Time
+}
+
+// Group is a json tagged struct to save it as a file on disk and represents a group or supergroup the bot has seen
+type Group struct {
+	// ID is the telegram chat id of the group
+	ID int64 `json:"id"`
+	// Title is the last known title of the group
+	Title string `json:"title"`
+	// Type is either "group" or "supergroup"
+	Type string `json:"type"`
+	// Username is the public username of the group, if any
+	Username string `json:"username"`
+	// FirstSeen is the time the bot saw the group for the first time
+	FirstSeen time.Time `json:"first_seen"`
+	// Joined is the time the bot was last added to the group. Zero if it was added before the registry existed
+	Joined time.Time `json:"joined"`
+	// Left is the time the bot was last removed from the group. Zero if it never left
+	Left time.Time `json:"left"`
+	// LastActivity is the time of the last message in the group
+	LastActivity time.Time `json:"last_activity"`
+	// Messages counts the messages the bot has seen in the group
+	Messages int64 `json:"messages"`
+	// Members counts the messages per user id
+	Members map[int]int64 `json:"members"`
+	// Tips counts the tips and claimed giveaways in the group
+	Tips int64 `json:"tips"`
+	// TipVolume is the sum of Tips
+	TipVolume uint64 `json:"tip_volume"`
+	// Settings are made by the admins of the group. nil if they never changed anything
+	Settings *GroupSettings `json:"settings,omitempty"`
+}
+
+// GroupSettings is a json tagged struct to save it as a file on disk (as part of the group registry) and represents the settings group admins made with /groupsettings
+type GroupSettings struct {
+	// MinTip is the minimum amount of a tip or giveaway in the group in XMR. 0 means MIN_TIP_AMOUNT applies
+	MinTip float64 `json:"min_tip"`
+	// Disabled are the commands that can't be used in the group, e.g. "tip"
+	Disabled []string `json:"disabled"`
+	// PublicConfirmations posts a confirmation of every tip to the group. Otherwise only the sender and the recipient are notified in PM
+	PublicConfirmations bool `json:"public_confirmations"`
+	// UpdatedBy is the telegram user id of the admin who made the last change
+	UpdatedBy int64 `json:"updated_by"`
+	// Updated is the time of the last change
+	Updated time.Time `json:"updated"`
+}
+
+// Deletion is a json tagged struct to save it as a file on disk and represents a group message the bot deletes later
+type Deletion struct {
+	ChatID    int64     `json:"chat_id"`
+	MessageID int       `json:"message_id"`
+	DeleteAt  time.Time `json:"delete_at"`
+}
+
+// FeeEstimate is the last fee estimate of /fee. It's shown when no new estimate can be made.
+type FeeEstimate struct {
+	// Time the estimate was made
+	Time time.Time
+	// Amount is the amount of the estimated transfer
+	Amount uint64
+	// Fees are the estimated fees per priority name. A missing priority couldn't be estimated
+	Fees map[string]uint64
+}
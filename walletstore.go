@@ -0,0 +1,60 @@
+package monerotipbot
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// walletStore is the outcome of the last store of the wallet file
+type walletStore struct {
+	mutex  sync.Mutex
+	stored time.Time
+	err    error
+}
+
+// save stores the wallet file and remembers the outcome for the health checks
+func (rw *resilientWallet) save() error {
+	err := rw.Store()
+
+	rw.store.mutex.Lock()
+	rw.store.err = err
+	if err == nil {
+		rw.store.stored = time.Now()
+	}
+	rw.store.mutex.Unlock()
+
+	if err != nil {
+		rw.logger().WithError(err).Error("Error while storing the wallet")
+		rw.metrics.Incr("walletrpc.store_failed.counter", 1)
+	}
+	return err
+}
+
+// lastStore returns the time of the last successful store and the error of the last attempt
+func (rw *resilientWallet) lastStore() (time.Time, error) {
+	rw.store.mutex.Lock()
+	defer rw.store.mutex.Unlock()
+	return rw.store.stored, rw.store.err
+}
+
+// storeWallet saves the wallet (IMPORTANT!)
+func (mtb *MoneroTipBot) storeWallet() error {
+	return mtb.walletrpc.save()
+}
+
+// walletStoreScheduler stores the wallet every WALLET_STORE_INTERVAL seconds. this saves the refresh progress
+// and retries a failed store after a transfer. state-changing calls store the wallet right away.
+func (mtb *MoneroTipBot) walletStoreScheduler() {
+	for {
+		interval := time.Duration(viper.GetInt("WALLET_STORE_INTERVAL")) * time.Second
+		if interval == 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		time.Sleep(interval)
+		mtb.jobWallet("walletstore").save()
+	}
+}
@@ -0,0 +1,198 @@
+package monerotipbot
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// apiTransport sends the Bot API requests to telegram_api_url instead of api.telegram.org,
+// e.g. to a local Bot API server or a fake one for testing
+type apiTransport struct {
+	endpoint *url.URL
+}
+
+func (t *apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.endpoint.Scheme
+	req.URL.Host = t.endpoint.Host
+	req.URL.Path = strings.TrimSuffix(t.endpoint.Path, "/") + req.URL.Path
+	req.Host = t.endpoint.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newBotAPI connects to the Bot API at telegram_api_url, if set, or api.telegram.org
+func newBotAPI() (*tgbotapi.BotAPI, error) {
+	client := &http.Client{}
+	if len(viper.GetString("telegram_api_url")) > 0 {
+		endpoint, err := url.Parse(viper.GetString("telegram_api_url"))
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = &apiTransport{endpoint: endpoint}
+	}
+	return tgbotapi.NewBotAPIWithClient(viper.GetString("telegram_bot_token"), client)
+}
+
+// webhookSecretPattern are the characters Telegram allows in secret_token
+var webhookSecretPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+func isWebhookMode() bool {
+	return viper.GetString("mode") == "webhook"
+}
+
+// webhookPath is the path Telegram posts the updates to. the secret keeps others from posting fake updates.
+func webhookPath() string {
+	return "/" + viper.GetString("webhook_secret")
+}
+
+// setWebhook registers webhook_url at Telegram. tgbotapi.SetWebhook can't send a secret_token, so the request is built here.
+func (mtb *MoneroTipBot) setWebhook() error {
+	params := map[string]string{
+		"url":          strings.TrimSuffix(viper.GetString("webhook_url"), "/") + webhookPath(),
+		"secret_token": viper.GetString("webhook_secret"),
+	}
+	if viper.GetInt("webhook_max_connections") > 0 {
+		params["max_connections"] = viper.GetString("webhook_max_connections")
+	}
+
+	var resp tgbotapi.APIResponse
+	var err error
+	// a self-signed certificate has to be uploaded, so Telegram trusts it
+	if viper.GetBool("webhook_upload_cert") {
+		resp, err = mtb.bot.UploadFile("setWebhook", params, "certificate", viper.GetString("webhook_cert"))
+	} else {
+		values := url.Values{}
+		for key, value := range params {
+			values.Set(key, value)
+		}
+		resp, err = mtb.bot.MakeRequest("setWebhook", values)
+	}
+	if err != nil {
+		return err
+	}
+	if !resp.Ok {
+		return fmt.Errorf("setWebhook failed: %s", resp.Description)
+	}
+	return nil
+}
+
+// webhookHandler hands the updates Telegram posts to the dispatcher in Run. it answers only after the update was taken,
+// so Telegram sends it again if the bot stops before.
+func (mtb *MoneroTipBot) webhookHandler(updates chan<- tgbotapi.Update) http.HandlerFunc {
+	secret := []byte(viper.GetString("webhook_secret"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != webhookPath() {
+			http.NotFound(w, r)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Telegram-Bot-Api-Secret-Token")), secret) != 1 {
+			mtb.metricIncr("webhook.unauthorized.counter", 1)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		update := tgbotapi.Update{}
+		err := json.NewDecoder(r.Body).Decode(&update)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		select {
+		case updates <- update:
+			w.WriteHeader(http.StatusOK)
+		case <-mtb.shutdown:
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		}
+	}
+}
+
+// listenWebhook starts the HTTP(S) listener on webhook_listen and registers the webhook.
+// without webhook_cert and webhook_key it serves plain HTTP, for running behind a reverse proxy that terminates TLS.
+func (mtb *MoneroTipBot) listenWebhook() (<-chan tgbotapi.Update, error) {
+	if len(viper.GetString("webhook_secret")) == 0 {
+		return nil, fmt.Errorf("webhook_secret must be set in webhook mode")
+	}
+	if !webhookSecretPattern.MatchString(viper.GetString("webhook_secret")) {
+		return nil, fmt.Errorf("webhook_secret must be 1 to 256 characters of A-Z, a-z, 0-9, _ and -")
+	}
+
+	updates := make(chan tgbotapi.Update)
+	mtb.webhook = &http.Server{
+		Addr:              viper.GetString("webhook_listen"),
+		Handler:           mtb.webhookHandler(updates),
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	// listen before registering, so the first update doesn't hit a closed port
+	listener, err := net.Listen("tcp", mtb.webhook.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := viper.GetString("webhook_cert")
+	key := viper.GetString("webhook_key")
+	go func() {
+		var err error
+		if len(cert) > 0 && len(key) > 0 {
+			err = mtb.webhook.ServeTLS(listener, cert, key)
+		} else {
+			err = mtb.webhook.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Error("Error while serving the webhook")
+		}
+	}()
+
+	err = mtb.setWebhook()
+	if err != nil {
+		mtb.webhook.Close()
+		return nil, err
+	}
+
+	logrus.WithField("listen", mtb.webhook.Addr).Info("Listening for webhook updates")
+	return updates, nil
+}
+
+// getUpdates returns the updates from the webhook in webhook mode or from long polling otherwise
+func (mtb *MoneroTipBot) getUpdates() (<-chan tgbotapi.Update, error) {
+	if isWebhookMode() {
+		return mtb.listenWebhook()
+	}
+
+	// getUpdates doesn't work while a webhook is set
+	_, err := mtb.bot.RemoveWebhook()
+	if err != nil {
+		return nil, err
+	}
+
+	// GetUpdatesChan confirms a batch to Telegram with the next getUpdates, after it passed all of it to the channel.
+	// without a buffer that only happens once the dispatcher took every update, so none is lost on Shutdown.
+	mtb.bot.Buffer = 0
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	return mtb.bot.GetUpdatesChan(u)
+}
+
+// closeWebhook stops the webhook listener. the webhook stays registered, so Telegram keeps the updates until the bot is back.
+func (mtb *MoneroTipBot) closeWebhook() {
+	if mtb.webhook == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	mtb.webhook.Shutdown(ctx)
+}
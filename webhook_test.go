@@ -0,0 +1,150 @@
+package monerotipbot
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const testWebhookSecret = "s3cret_token-42"
+
+// fakeBotAPI answers getMe and setWebhook like the Bot API and hands the parameters of setWebhook to the test
+type fakeBotAPI struct {
+	*httptest.Server
+	setwebhook chan map[string]string
+}
+
+func newFakeBotAPI(t *testing.T) *fakeBotAPI {
+	fake := &fakeBotAPI{setwebhook: make(chan map[string]string, 1)}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var result interface{} = true
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/getMe"):
+			result = tgbotapi.User{ID: 1, UserName: "testbot", IsBot: true}
+		case strings.HasSuffix(r.URL.Path, "/setWebhook"):
+			r.ParseForm()
+			fake.setwebhook <- map[string]string{
+				"url":          r.Form.Get("url"),
+				"secret_token": r.Form.Get("secret_token"),
+			}
+		default:
+			t.Errorf("unexpected Bot API call %s", r.URL.Path)
+		}
+		data, _ := json.Marshal(result)
+		json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: true, Result: data})
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+// newWebhookTestBot returns a bot in webhook mode that talks to a fake Bot API
+func newWebhookTestBot(t *testing.T) (*MoneroTipBot, *fakeBotAPI) {
+	fake := newFakeBotAPI(t)
+	t.Cleanup(viper.Reset)
+	viper.Set("mode", "webhook")
+	viper.Set("telegram_api_url", fake.URL)
+	viper.Set("telegram_bot_token", "123:test")
+	viper.Set("webhook_url", "https://bot.example.com/")
+	viper.Set("webhook_secret", testWebhookSecret)
+
+	bot, err := newBotAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &MoneroTipBot{
+		bot:      bot,
+		metrics:  &Metrics{},
+		shutdown: make(chan struct{}),
+	}, fake
+}
+
+func postUpdate(t *testing.T, url string, secret string, body string) int {
+	req, err := http.NewRequest(http.MethodPost, url+"/"+testWebhookSecret, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) > 0 {
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSetWebhook(t *testing.T) {
+	mtb, fake := newWebhookTestBot(t)
+
+	err := mtb.setWebhook()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := <-fake.setwebhook
+	if params["url"] != "https://bot.example.com/"+testWebhookSecret {
+		t.Errorf("url = %q", params["url"])
+	}
+	if params["secret_token"] != testWebhookSecret {
+		t.Errorf("secret_token = %q", params["secret_token"])
+	}
+}
+
+func TestWebhookRejectsWrongSecret(t *testing.T) {
+	mtb, _ := newWebhookTestBot(t)
+	updates := make(chan tgbotapi.Update, 1)
+	server := httptest.NewServer(mtb.webhookHandler(updates))
+	defer server.Close()
+
+	for _, secret := range []string{"", "wrong", testWebhookSecret + "x"} {
+		status := postUpdate(t, server.URL, secret, `{"update_id":1}`)
+		if status != http.StatusUnauthorized {
+			t.Errorf("secret %q: status = %d, want %d", secret, status, http.StatusUnauthorized)
+		}
+	}
+	if len(updates) != 0 {
+		t.Errorf("%d updates delivered with a wrong secret", len(updates))
+	}
+}
+
+func TestWebhookDeliversUpdate(t *testing.T) {
+	mtb, _ := newWebhookTestBot(t)
+	updates := make(chan tgbotapi.Update, 1)
+	server := httptest.NewServer(mtb.webhookHandler(updates))
+	defer server.Close()
+
+	status := postUpdate(t, server.URL, testWebhookSecret, `{"update_id":7,"message":{"message_id":3,"text":"/balance","chat":{"id":42,"type":"private"}}}`)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+
+	if len(updates) != 1 {
+		t.Fatalf("%d updates delivered, want 1", len(updates))
+	}
+	update := <-updates
+	if update.UpdateID != 7 || update.Message == nil || update.Message.Text != "/balance" {
+		t.Errorf("unexpected update %+v", update)
+	}
+}
+
+func TestListenWebhookRejectsInvalidSecret(t *testing.T) {
+	mtb, _ := newWebhookTestBot(t)
+
+	for _, secret := range []string{"with space", "path/secret", "umlaut-ä", strings.Repeat("a", 257)} {
+		viper.Set("webhook_secret", secret)
+		_, err := mtb.listenWebhook()
+		if err == nil {
+			mtb.closeWebhook()
+			t.Errorf("secret %q accepted", secret)
+		}
+	}
+	if !webhookSecretPattern.MatchString(strings.Repeat("a", 256)) {
+		t.Error("secret of 256 characters refused")
+	}
+}
@@ -0,0 +1,282 @@
+package monerotipbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omani/go-monero-rpc-client/wallet"
+	"github.com/spf13/viper"
+)
+
+const (
+	whitelistActionAdd     = "add"
+	whitelistActionDisable = "disable"
+)
+
+var whitelistmutex sync.Mutex
+
+// loadWhitelists reads all whitelists from WHITELIST_FILE. A missing file means no whitelists yet.
+func loadWhitelists() (map[int64]*Whitelist, error) {
+	whitelists := make(map[int64]*Whitelist)
+
+	file, err := ioutil.ReadFile(viper.GetString("WHITELIST_FILE"))
+	if err != nil {
+		return whitelists, nil
+	}
+
+	var entries []*Whitelist
+	err = json.Unmarshal(file, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		whitelists[entry.UserID] = entry
+	}
+
+	return whitelists, nil
+}
+
+// saveWhitelistsToFile must be called with whitelistmutex held
+func (mtb *MoneroTipBot) saveWhitelistsToFile() error {
+	var entries []*Whitelist
+	for _, entry := range mtb.whitelists {
+		entries = append(entries, entry)
+	}
+
+	file, err := json.MarshalIndent(entries, "", " ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(viper.GetString("WHITELIST_FILE"), file, 0600)
+}
+
+func whitelistDelay() time.Duration {
+	return time.Duration(viper.GetInt("WHITELIST_DELAY")) * time.Hour
+}
+
+func (w *Whitelist) contains(address string) bool {
+	for _, a := range w.Addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWhitelist returns an error if the user has the whitelist enabled and address is not on it
+func (mtb *MoneroTipBot) checkWhitelist(address string) error {
+	whitelistmutex.Lock()
+	defer whitelistmutex.Unlock()
+
+	whitelist, ok := mtb.whitelists[int64(mtb.from.ID)]
+	if !ok || !whitelist.Enabled {
+		return nil
+	}
+	if whitelist.contains(address) {
+		return nil
+	}
+
+	return fmt.Errorf("Address %s is not on your withdrawal whitelist. Add it with /whitelist add %s (takes effect after %d hours).", address, address, viper.GetInt("WHITELIST_DELAY"))
+}
+
+func (mtb *MoneroTipBot) parseCommandWHITELIST() error {
+	msg := mtb.newReplyMessage(true)
+
+	whitelistmutex.Lock()
+	defer whitelistmutex.Unlock()
+
+	userid := int64(mtb.from.ID)
+	whitelist, ok := mtb.whitelists[userid]
+	if !ok {
+		whitelist = &Whitelist{UserID: userid}
+	}
+
+	split := strings.Fields(mtb.message.CommandArguments())
+	if len(split) == 0 {
+		msg.Text = whitelist.String()
+		return mtb.reply(msg)
+	}
+
+	// loosening or changing the whitelist is a change to the security settings
+	if split[0] == "add" || split[0] == "remove" || split[0] == "disable" {
+		err := mtb.requireSecondFactor()
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+
+	switch split[0] {
+	case "enable":
+		if whitelist.Enabled {
+			msg.Text = "Whitelist is already enabled."
+			return mtb.reply(msg)
+		}
+		// enabling only restricts the account further. takes effect immediately.
+		whitelist.Enabled = true
+		msg.Text = "Whitelist enabled. /send and /withdraw will only go to whitelisted addresses from now on."
+	case "disable":
+		if !whitelist.Enabled {
+			msg.Text = "Whitelist is not enabled."
+			return mtb.reply(msg)
+		}
+		for _, change := range whitelist.Pending {
+			if change.Action == whitelistActionDisable {
+				msg.Text = fmt.Sprintf("Whitelist is already scheduled to be disabled at %s.", change.EffectiveAt.Format(time.RFC1123))
+				return mtb.reply(msg)
+			}
+		}
+		change := &WhitelistChange{Action: whitelistActionDisable, EffectiveAt: now.Add(whitelistDelay())}
+		whitelist.Pending = append(whitelist.Pending, change)
+		msg.Text = fmt.Sprintf("Whitelist will be disabled at %s.\n\nIf this wasn't you, type /whitelist cancel immediately.", change.EffectiveAt.Format(time.RFC1123))
+	case "add":
+		if len(split) != 2 {
+			msg.Text = "Please specify the address to whitelist: /whitelist add ADDRESSHERE"
+			return mtb.reply(msg)
+		}
+		address := split[1]
+		if whitelist.contains(address) {
+			msg.Text = "Address is already whitelisted."
+			return mtb.reply(msg)
+		}
+		for _, change := range whitelist.Pending {
+			if change.Action == whitelistActionAdd && change.Address == address {
+				msg.Text = fmt.Sprintf("Address is already scheduled to be added at %s.", change.EffectiveAt.Format(time.RFC1123))
+				return mtb.reply(msg)
+			}
+		}
+
+		validaddr, err := mtb.walletrpc.ValidateAddress(&wallet.RequestValidateAddress{Address: address, AnyNetType: viper.GetBool("IS_STAGENET_WALLET")})
+		if err != nil {
+			msg.Text = "Something went wrong. Could not validate address."
+			return mtb.reply(msg)
+		}
+		if !validaddr.Valid {
+			msg.Text = "This is not a valid monero address. Aborted."
+			return mtb.reply(msg)
+		}
+
+		// a disabled whitelist restricts nothing, so there is nothing to protect yet
+		if !whitelist.Enabled {
+			whitelist.Addresses = append(whitelist.Addresses, address)
+			msg.Text = fmt.Sprintf("Address %s added to your whitelist.", address)
+			break
+		}
+		change := &WhitelistChange{Action: whitelistActionAdd, Address: address, EffectiveAt: now.Add(whitelistDelay())}
+		whitelist.Pending = append(whitelist.Pending, change)
+		msg.Text = fmt.Sprintf("Address %s will be added to your whitelist at %s.\n\nIf this wasn't you, type /whitelist cancel immediately.", address, change.EffectiveAt.Format(time.RFC1123))
+	case "remove":
+		if len(split) != 2 {
+			msg.Text = "Please specify the address to remove: /whitelist remove ADDRESSHERE"
+			return mtb.reply(msg)
+		}
+		if !whitelist.contains(split[1]) {
+			msg.Text = "Address is not whitelisted."
+			return mtb.reply(msg)
+		}
+		// removing only restricts the account further. takes effect immediately.
+		for i, address := range whitelist.Addresses {
+			if address == split[1] {
+				whitelist.Addresses = append(whitelist.Addresses[:i], whitelist.Addresses[i+1:]...)
+				break
+			}
+		}
+		msg.Text = fmt.Sprintf("Address %s removed from your whitelist.", split[1])
+	case "cancel":
+		if len(whitelist.Pending) == 0 {
+			msg.Text = "No pending whitelist changes."
+			return mtb.reply(msg)
+		}
+		whitelist.Pending = nil
+		msg.Text = "All pending whitelist changes have been canceled."
+	default:
+		msg.Text = "Unknown whitelist command. See /help whitelist"
+		return mtb.reply(msg)
+	}
+
+	mtb.whitelists[userid] = whitelist
+	err := mtb.saveWhitelistsToFile()
+	if err != nil {
+		msg.Text = fmt.Sprintf("Error while saving whitelist: %s", err)
+		return mtb.reply(msg)
+	}
+	mtb.metricIncr("whitelist_changed.counter", 1)
+
+	return mtb.reply(msg)
+}
+
+func (w *Whitelist) String() string {
+	status := "disabled"
+	if w.Enabled {
+		status = "enabled"
+	}
+	out := fmt.Sprintf("Whitelist: %s\n\nAddresses:", status)
+	if len(w.Addresses) == 0 {
+		out = fmt.Sprintf("%s\nnone", out)
+	}
+	for _, address := range w.Addresses {
+		out = fmt.Sprintf("%s\n%s", out, address)
+	}
+	if len(w.Pending) > 0 {
+		out = fmt.Sprintf("%s\n\nPending changes:", out)
+		for _, change := range w.Pending {
+			out = fmt.Sprintf("%s\n%s %s at %s", out, change.Action, change.Address, change.EffectiveAt.Format(time.RFC1123))
+		}
+	}
+	return out
+}
+
+// applyWhitelistChanges applies every pending change that is due and notifies the user about it
+func (mtb *MoneroTipBot) applyWhitelistChanges(now time.Time) error {
+	whitelistmutex.Lock()
+	defer whitelistmutex.Unlock()
+
+	changed := false
+	for userid, whitelist := range mtb.whitelists {
+		var pending []*WhitelistChange
+		for _, change := range whitelist.Pending {
+			if now.Before(change.EffectiveAt) {
+				pending = append(pending, change)
+				continue
+			}
+
+			msg := &Message{Format: true, ChatID: userid, log: jobLogger("whitelist")}
+			switch change.Action {
+			case whitelistActionAdd:
+				if !whitelist.contains(change.Address) {
+					whitelist.Addresses = append(whitelist.Addresses, change.Address)
+				}
+				msg.Text = fmt.Sprintf("Address %s is now on your withdrawal whitelist.", change.Address)
+			case whitelistActionDisable:
+				whitelist.Enabled = false
+				msg.Text = "Your withdrawal whitelist is now disabled."
+			}
+			mtb.reply(msg)
+			changed = true
+		}
+		whitelist.Pending = pending
+	}
+
+	if !changed {
+		return nil
+	}
+	return mtb.saveWhitelistsToFile()
+}
+
+// whitelistScheduler periodically applies time-locked whitelist changes
+func (mtb *MoneroTipBot) whitelistScheduler() {
+	for {
+		err := mtb.applyWhitelistChanges(time.Now())
+		if err != nil {
+			jobLogger("whitelist").WithError(err).Error("Error while applying whitelist changes")
+		}
+
+		time.Sleep(time.Minute)
+	}
+}